@@ -0,0 +1,74 @@
+package kea
+
+import (
+	"slices"
+	"strings"
+)
+
+// Backend is one of several independent Kea servers, such as one per site
+// serving its own subnets, reached through its own endpoints.
+type Backend struct {
+	Name      string
+	Endpoints *EndpointPool
+}
+
+// controlAgentClients returns a client for the control_agent endpoints and
+// one for each named backend. There are none when neither is configured.
+func (k Kea) controlAgentClients() (clients []ControlAgentClient) {
+	if k.Endpoints != nil || len(k.ControlAgents) > 0 {
+		clients = append(clients, k.controlAgentClient())
+	}
+	for _, backend := range k.Backends {
+		clients = append(clients, ControlAgentClient{
+			Backend:   backend.Name,
+			Endpoints: backend.Endpoints,
+			UseIPv4:   k.UseIPv4 == "true",
+			UseIPv6:   k.UseIPv6 == "true",
+		})
+	}
+	return
+}
+
+// MergeBackends keeps the records of only one backend when a name is found
+// on several: the one holding the lease with the newest cltt, as the client
+// has most recently been seen there. Records from other sources, and
+// backends which only have reservations, are kept unless some backend has a
+// lease.
+func MergeBackends(records []Record) []Record {
+	newest := map[string]int64{}
+	var backends []string
+	for _, record := range records {
+		if !isBackendRecord(record) {
+			continue
+		}
+		if !slices.Contains(backends, record.Backend) {
+			backends = append(backends, record.Backend)
+		}
+		newest[record.Backend] = max(newest[record.Backend], record.Cltt)
+	}
+	if len(backends) < 2 {
+		return records
+	}
+
+	winner := backends[0]
+	for _, backend := range backends[1:] {
+		if newest[backend] > newest[winner] {
+			winner = backend
+		}
+	}
+	if newest[winner] == 0 {
+		return records
+	}
+
+	log.Debugf("%s found on backends %s, answering from %s with the newest lease",
+		records[0].Hostname, strings.Join(backends, ", "), winner)
+	return slices.DeleteFunc(records, func(record Record) bool {
+		return isBackendRecord(record) && record.Backend != winner
+	})
+}
+
+// isBackendRecord reports whether a record came from a Kea server's control
+// agent, rather than from a file or database.
+func isBackendRecord(record Record) bool {
+	return record.Source == SourceControlAgentLeases || record.Source == SourceControlAgentReservations
+}
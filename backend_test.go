@@ -0,0 +1,100 @@
+package kea
+
+import (
+	"context"
+	"testing"
+)
+
+func testBackendRecord(source string, backend string, ip string, cltt int64) Record {
+	record := testRecord(source, "laptop", ip)
+	record.Backend = backend
+	record.Cltt = cltt
+	return record
+}
+
+func TestMergeBackends(t *testing.T) {
+	tests := []struct {
+		records  []Record
+		expected string
+	}{
+		// The backend which saw the client most recently wins.
+		{[]Record{
+			testBackendRecord(SourceControlAgentLeases, "north", "10.1.0.20", 1000),
+			testBackendRecord(SourceControlAgentLeases, "south", "10.2.0.20", 2000),
+			testBackendRecord(SourceControlAgentReservations, "north", "10.1.0.21", 0),
+		}, "control_agent_leases=10.2.0.20"},
+		// Records from files and databases aren't backend records.
+		{[]Record{
+			testBackendRecord(SourceControlAgentLeases, "north", "10.1.0.20", 2000),
+			testBackendRecord(SourceControlAgentLeases, "south", "10.2.0.20", 1000),
+			testRecord(SourceDHCP4Conf, "laptop", "10.3.0.20"),
+		}, "control_agent_leases=10.1.0.20 dhcp4_conf=10.3.0.20"},
+		// Reservations alone don't decide between backends.
+		{[]Record{
+			testBackendRecord(SourceControlAgentReservations, "north", "10.1.0.20", 0),
+			testBackendRecord(SourceControlAgentReservations, "south", "10.2.0.20", 0),
+		}, "control_agent_reservations=10.1.0.20 control_agent_reservations=10.2.0.20"},
+		// The unnamed control_agent counts as a backend.
+		{[]Record{
+			testBackendRecord(SourceControlAgentLeases, "", "10.1.0.20", 1000),
+			testBackendRecord(SourceControlAgentLeases, "south", "10.2.0.20", 2000),
+		}, "control_agent_leases=10.2.0.20"},
+	}
+	for i, test := range tests {
+		if actual := recordSources(MergeBackends(test.records)); actual != test.expected {
+			t.Errorf("Test %d: expected %q, got %q", i, test.expected, actual)
+		}
+	}
+}
+
+func TestLookupNameMergesBackends(t *testing.T) {
+	north := testSource{name: SourceControlAgentLeases, records: []Record{
+		testBackendRecord(SourceControlAgentLeases, "north", "10.1.0.20", 1000),
+	}}
+	south := testSource{name: SourceControlAgentLeases, records: []Record{
+		testBackendRecord(SourceControlAgentLeases, "south", "10.2.0.20", 2000),
+	}}
+
+	kea := Kea{Sources: []Source{north, south}}
+	records, err := kea.LookupName(context.Background(), "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Backend != "south" {
+		t.Errorf("expected the south backend's lease, got %v", records)
+	}
+}
+
+func TestConfiguredSourcesForBackends(t *testing.T) {
+	kea := Kea{
+		ControlAgentLeases:       "true",
+		ControlAgentReservations: "true",
+		UseIPv4:                  "true",
+		Backends: []Backend{
+			{Name: "north", Endpoints: NewEndpointPool([]string{"http://north.example.com:8000"}, false, nil, false)},
+			{Name: "south", Endpoints: NewEndpointPool([]string{"http://south.example.com:8000"}, false, nil, false)},
+		},
+	}
+
+	sources, err := OrderSources(kea.ConfiguredSources(), []string{SourceControlAgentReservations, SourceControlAgentLeases})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var labels []string
+	for _, source := range sources {
+		labels = append(labels, sourceLabel(source))
+	}
+	expected := []string{
+		"control_agent_reservations (north)", "control_agent_reservations (south)",
+		"control_agent_leases (north)", "control_agent_leases (south)",
+	}
+	if len(labels) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, labels)
+	}
+	for i := range expected {
+		if labels[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected, labels)
+			break
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package kea
+
+import (
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policies for a hostname whose addresses of one family are held by more
+// than one client, as set by conflict_policy.
+const (
+	// ConflictPolicyAll answers with every address.
+	ConflictPolicyAll = "all"
+	// ConflictPolicyNewest answers with the addresses of the client holding
+	// the lease with the newest cltt.
+	ConflictPolicyNewest = "newest"
+	// ConflictPolicyReservationWins answers with the reserved addresses,
+	// or every address when none is reserved.
+	ConflictPolicyReservationWins = "reservation_wins"
+	// ConflictPolicyPerMACNewest answers with the newest address of each
+	// client, whether or not there is a conflict.
+	ConflictPolicyPerMACNewest = "per_mac_newest"
+	// ConflictPolicyRefuse answers with no address of the conflicting family.
+	ConflictPolicyRefuse = "refuse"
+)
+
+// ConflictPolicies lists the valid conflict policies.
+var ConflictPolicies = []string{
+	ConflictPolicyAll,
+	ConflictPolicyNewest,
+	ConflictPolicyReservationWins,
+	ConflictPolicyPerMACNewest,
+	ConflictPolicyRefuse,
+}
+
+// Bounds on what a ConflictLog remembers.
+const conflictLogSize = 4096
+const conflictLogExpiry = time.Hour
+
+// ConflictLog remembers the conflicts already logged and counted, by
+// hostname and family, so each is only reported once an hour however often
+// the hostname is queried. Once it holds conflictLogSize conflicts, the
+// oldest is forgotten.
+type ConflictLog struct {
+	// Server labels the conflicts counted, as the metrics plugin labels
+	// queries to the server block the plugin is in.
+	Server string
+
+	mu     sync.Mutex
+	logged map[string]time.Time
+}
+
+func (l *ConflictLog) server() string {
+	if l == nil {
+		return ""
+	}
+	return l.Server
+}
+
+// seen reports whether a conflict was reported within conflictLogExpiry, and
+// otherwise remembers it as reported now.
+func (l *ConflictLog) seen(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if at, ok := l.logged[key]; ok && now.Sub(at) < conflictLogExpiry {
+		return true
+	}
+	if l.logged == nil {
+		l.logged = map[string]time.Time{}
+	}
+	if _, ok := l.logged[key]; !ok && len(l.logged) >= conflictLogSize {
+		oldest := ""
+		for k, at := range l.logged {
+			if now.Sub(at) >= conflictLogExpiry {
+				delete(l.logged, k)
+			} else if oldest == "" || at.Before(l.logged[oldest]) {
+				oldest = k
+			}
+		}
+		if len(l.logged) >= conflictLogSize {
+			delete(l.logged, oldest)
+		}
+	}
+	l.logged[key] = now
+	return false
+}
+
+// ResolveConflicts applies the conflict policy to a hostname's records, one
+// address family at a time, and keeps the records left in their order.
+// Records are held by the same client when they share an identifier, as
+// sameClient tells.
+func (k Kea) ResolveConflicts(records []Record) []Record {
+	var kept []Record
+	for _, family := range []int{4, 6} {
+		var inFamily []Record
+		for _, record := range records {
+			if recordFamily(record) == family {
+				inFamily = append(inFamily, record)
+			}
+		}
+		conflict := hasConflict(inFamily)
+		if conflict {
+			k.reportConflict(family, inFamily)
+		}
+
+		switch {
+		case k.ConflictPolicy == ConflictPolicyPerMACNewest:
+			inFamily = newestPerClient(inFamily)
+		case !conflict:
+		case k.ConflictPolicy == ConflictPolicyNewest:
+			inFamily = newestClient(inFamily)
+		case k.ConflictPolicy == ConflictPolicyReservationWins:
+			reserved := slices.DeleteFunc(slices.Clone(inFamily), func(r Record) bool { return r.Kind == RecordKindLease })
+			if len(reserved) > 0 {
+				inFamily = reserved
+			}
+		case k.ConflictPolicy == ConflictPolicyRefuse:
+			inFamily = nil
+		}
+		kept = append(kept, inFamily...)
+	}
+
+	return slices.DeleteFunc(slices.Clone(records), func(r Record) bool { return !containsIP(kept, r) })
+}
+
+// reportConflict logs and counts a conflict, unless Conflicts has seen it
+// recently. Without Conflicts every conflict is reported.
+func (k Kea) reportConflict(family int, records []Record) {
+	hostname := strings.ToLower(strings.TrimSuffix(records[0].Hostname, "."))
+	if k.Conflicts != nil && k.Conflicts.seen(fmt.Sprintf("%s/%d", hostname, family), time.Now()) {
+		return
+	}
+
+	var clients []string
+	groups := clientGroups(records)
+	for i, record := range records {
+		if groups[i] != -1 && !slices.Contains(groups[:i], groups[i]) {
+			clients = append(clients, recordClient(record))
+		}
+	}
+	slices.Sort(clients)
+
+	policy := k.ConflictPolicy
+	if policy == "" {
+		policy = ConflictPolicyAll
+	}
+	log.Warningf("%s has IPv%d addresses held by %d clients (%s), answering with conflict_policy %s",
+		hostname, family, len(clients), strings.Join(clients, ", "), policy)
+	hostnameConflicts.WithLabelValues(k.Conflicts.server(), familyLabel(family)).Inc()
+}
+
+// sameClient reports whether two records are held by the same client: they
+// share a hardware address, including one embedded in a DUID or an Ethernet
+// client-id, or a client-id or DUID.
+func sameClient(a Record, b Record) bool {
+	if a.ClientID != "" && normalizeIdentifier(a.ClientID) == normalizeIdentifier(b.ClientID) {
+		return true
+	}
+	macA := clientMAC(a)
+	return macA != "" && macA == clientMAC(b)
+}
+
+// clientMAC returns the hardware address of a record's client as recordMAC
+// does, or for DHCPv4 the one in a client-id of hardware type 1, Ethernet.
+func clientMAC(record Record) string {
+	if mac, _ := recordMAC(record); mac != "" || record.IP.To4() == nil {
+		return mac
+	}
+	clientID, err := hex.DecodeString(normalizeIdentifier(record.ClientID))
+	if err != nil || len(clientID) != 7 || clientID[0] != 1 {
+		return ""
+	}
+	return splitHex(hex.EncodeToString(clientID[1:]), ":")
+}
+
+// clientGroups numbers the clients holding records, so that records held by
+// the same client, directly or through another of its records, have the same
+// number. Records without a known client have -1.
+func clientGroups(records []Record) []int {
+	groups := make([]int, len(records))
+	for i, record := range records {
+		groups[i] = -1
+		if recordClient(record) == "" {
+			continue
+		}
+		groups[i] = i
+		for j := range i {
+			if groups[j] == -1 || groups[j] == groups[i] || !sameClient(records[j], record) {
+				continue
+			}
+			merged := groups[i]
+			for k := range i + 1 {
+				if groups[k] == merged {
+					groups[k] = groups[j]
+				}
+			}
+		}
+	}
+	return groups
+}
+
+// newestClient keeps the records of the client holding the newest lease.
+func newestClient(records []Record) []Record {
+	groups := clientGroups(records)
+	newest := 0
+	for i, record := range records {
+		if record.Cltt > records[newest].Cltt {
+			newest = i
+		}
+	}
+	var kept []Record
+	for i, record := range records {
+		if groups[i] == groups[newest] {
+			kept = append(kept, record)
+		}
+	}
+	return kept
+}
+
+// newestPerClient keeps the newest record of each client. Records without a
+// known client are all kept.
+func newestPerClient(records []Record) []Record {
+	groups := clientGroups(records)
+	newest := map[int]int{}
+	for i, record := range records {
+		if previous, ok := newest[groups[i]]; groups[i] != -1 && (!ok || record.Cltt > records[previous].Cltt) {
+			newest[groups[i]] = i
+		}
+	}
+	var kept []Record
+	for i, record := range records {
+		if groups[i] == -1 || newest[groups[i]] == i {
+			kept = append(kept, record)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,133 @@
+package kea
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ionothanus/coredns-kea/keaclient"
+	"github.com/ionothanus/coredns-kea/keatest"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestResolveConflicts(t *testing.T) {
+	records := []Record{
+		{Hostname: "tablet", IP: net.ParseIP("10.0.0.70"), HwAddress: "00:11:22:33:44:c1", Cltt: 100, Kind: RecordKindLease},
+		{Hostname: "tablet", IP: net.ParseIP("2001:db8:1::70"), HwAddress: "00:11:22:33:44:c1", Cltt: 100, Kind: RecordKindLease},
+		{Hostname: "tablet", IP: net.ParseIP("10.0.0.71"), HwAddress: "00:11:22:33:44:c2", Cltt: 300, Kind: RecordKindLease},
+		{Hostname: "tablet", IP: net.ParseIP("10.0.0.72"), HwAddress: "00:11:22:33:44:c2", Cltt: 200, Kind: RecordKindLease},
+		{Hostname: "tablet", IP: net.ParseIP("10.0.0.73"), HwAddress: "00:11:22:33:44:c3", Kind: RecordKindReservation},
+	}
+
+	tests := []struct {
+		policy   string
+		expected string
+	}{
+		{ConflictPolicyAll, "10.0.0.70 2001:db8:1::70 10.0.0.71 10.0.0.72 10.0.0.73"},
+		{ConflictPolicyNewest, "2001:db8:1::70 10.0.0.71 10.0.0.72"},
+		{ConflictPolicyReservationWins, "2001:db8:1::70 10.0.0.73"},
+		{ConflictPolicyPerMACNewest, "10.0.0.70 2001:db8:1::70 10.0.0.71 10.0.0.73"},
+		{ConflictPolicyRefuse, "2001:db8:1::70"},
+	}
+
+	before := testutil.ToFloat64(hostnameConflicts.WithLabelValues("dns://:53", "ipv4"))
+	conflicts := &ConflictLog{Server: "dns://:53"}
+	for _, tc := range tests {
+		kea := Kea{ConflictPolicy: tc.policy, Conflicts: conflicts}
+		var ips []string
+		for _, ip := range RecordIPs(kea.ResolveConflicts(records)) {
+			ips = append(ips, ip.String())
+		}
+		if strings.Join(ips, " ") != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.policy, tc.expected, strings.Join(ips, " "))
+		}
+	}
+
+	// The conflict is only counted once, however often it is resolved.
+	if count := testutil.ToFloat64(hostnameConflicts.WithLabelValues("dns://:53", "ipv4")) - before; count != 1 {
+		t.Errorf("expected the conflict to be counted once, got %v", count)
+	}
+	if count := testutil.ToFloat64(hostnameConflicts.WithLabelValues("dns://:53", "ipv6")); count != 0 {
+		t.Errorf("expected no IPv6 conflict, got %v", count)
+	}
+}
+
+func TestResolveConflictsSameClient(t *testing.T) {
+	// A lease with only a client-id or DUID, and a reservation with only the
+	// hardware address of the same client, are no conflict.
+	records := []Record{
+		{Hostname: "printer", IP: net.ParseIP("10.0.0.80"), ClientID: "01:00:11:22:33:44:d1", Cltt: 100, Kind: RecordKindLease},
+		{Hostname: "printer", IP: net.ParseIP("10.0.0.81"), HwAddress: "00:11:22:33:44:d1", Kind: RecordKindReservation},
+		{Hostname: "printer", IP: net.ParseIP("2001:db8:1::80"), ClientID: "00:03:00:01:00:11:22:33:44:d1", Cltt: 100, Kind: RecordKindLease},
+		{Hostname: "printer", IP: net.ParseIP("2001:db8:1::81"), HwAddress: "00:11:22:33:44:d1", Kind: RecordKindReservation},
+	}
+	if hasConflict(records) {
+		t.Errorf("expected no conflict between the records of one client")
+	}
+
+	kea := Kea{ConflictPolicy: ConflictPolicyRefuse}
+	if resolved := kea.ResolveConflicts(records); len(resolved) != len(records) {
+		t.Errorf("expected every record to be kept, got %v", RecordIPs(resolved))
+	}
+}
+
+func TestConflictLog(t *testing.T) {
+	var conflicts ConflictLog
+	now := time.Now()
+	if conflicts.seen("tablet/4", now) {
+		t.Error("expected a new conflict not to be seen")
+	}
+	if !conflicts.seen("tablet/4", now.Add(time.Minute)) {
+		t.Error("expected the conflict to be seen again")
+	}
+	if conflicts.seen("tablet/4", now.Add(conflictLogExpiry)) {
+		t.Error("expected the conflict to expire")
+	}
+
+	for i := range conflictLogSize + 10 {
+		conflicts.seen(fmt.Sprintf("host%d/4", i), now.Add(time.Duration(i)*time.Millisecond))
+	}
+	if len(conflicts.logged) != conflictLogSize {
+		t.Errorf("expected %d conflicts to be kept, got %d", conflictLogSize, len(conflicts.logged))
+	}
+	if _, ok := conflicts.logged["host0/4"]; ok {
+		t.Error("expected the oldest conflict to be forgotten")
+	}
+}
+
+func TestConflictPolicyLookup(t *testing.T) {
+	// The laptop was replaced by a new one with the same name.
+	fixture := testFixture(t)
+	fixture.Leases = append(fixture.Leases, keaclient.Lease{
+		IPAddress: "10.0.0.22", HwAddress: "00:11:22:33:44:dd", Hostname: "laptop", SubnetID: 1, Cltt: 1700003000, ValidLft: 3600,
+	})
+	server := keatest.NewControlAgent(t, fixture)
+
+	kea := Kea{
+		ControlAgents:            []string{server.URL},
+		ControlAgentLeases:       "true",
+		ControlAgentReservations: "true",
+		UseIPv4:                  "true",
+		UseIPv6:                  "true",
+	}
+	if ips := hostnameIPs(t, kea, "laptop"); ips != "10.0.0.20 10.0.0.22 2001:db8:1::20" {
+		t.Errorf("expected every address by default, got %s", ips)
+	}
+
+	kea.ConflictPolicy = ConflictPolicyNewest
+	if ips := hostnameIPs(t, kea, "laptop"); ips != "10.0.0.22 2001:db8:1::20" {
+		t.Errorf("expected the newest laptop's address, got %s", ips)
+	}
+
+	// The policy applies to single-source lookups as well.
+	info, err := kea.ControlAgentGetIPsForLease("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info) != 2 || info[0].String() != "10.0.0.22" {
+		t.Errorf("expected the newest laptop's address, got %v", info)
+	}
+}
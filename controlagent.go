@@ -0,0 +1,330 @@
+package kea
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/ionothanus/coredns-kea/keaclient"
+)
+
+// ControlAgentClient sends commands to Kea control agents, or to daemons'
+// control sockets.
+type ControlAgentClient struct {
+	// Backend names the Kea server the endpoints belong to, when several are
+	// configured.
+	Backend   string
+	Endpoints *EndpointPool
+	UseIPv4   bool
+	UseIPv6   bool
+}
+
+// serviceForIP returns the Kea service responsible for an address.
+func serviceForIP(ip net.IP) string {
+	if ip.To4() != nil {
+		return KEA_IPV4_SERVICE_NAME
+	}
+	return KEA_IPV6_SERVICE_NAME
+}
+
+func (c ControlAgentClient) Request(ctx context.Context, requestBody string) (responseBody []byte, err error) {
+	return c.Endpoints.Request(ctx, requestBody)
+}
+
+func (c ControlAgentClient) api() keaclient.Client {
+	return keaclient.Client{Transport: c.Endpoints}
+}
+
+// families reports which address families are enabled and have the
+// command available, as "leaseN-..." commands are named by family.
+func (c ControlAgentClient) families(command func(family int) string) (useIPv4 bool, useIPv6 bool) {
+	useIPv4 = c.UseIPv4 && c.Endpoints.Supports(KEA_IPV4_SERVICE_NAME, command(4))
+	useIPv6 = c.UseIPv6 && c.Endpoints.Supports(KEA_IPV6_SERVICE_NAME, command(6))
+	return
+}
+
+// configSubnets holds the subnets of a DHCP daemon's configuration, as
+// returned by config-get, or of one of its shared networks.
+type configSubnets struct {
+	Subnet4 []struct {
+		ID int `json:"id"`
+	} `json:"subnet4"`
+	Subnet6 []struct {
+		ID int `json:"id"`
+	} `json:"subnet6"`
+	SharedNetworks []configSubnets `json:"shared-networks"`
+}
+
+func (c configSubnets) ids() (ids []int) {
+	for _, subnet := range c.Subnet4 {
+		ids = append(ids, subnet.ID)
+	}
+	for _, subnet := range c.Subnet6 {
+		ids = append(ids, subnet.ID)
+	}
+	for _, network := range c.SharedNetworks {
+		ids = append(ids, network.ids()...)
+	}
+	return
+}
+
+// subnetIDs returns the IDs of the subnets a family's service is configured
+// with, including those in shared networks.
+func (c ControlAgentClient) subnetIDs(ctx context.Context, family int) (ids []int, err error) {
+	replies, err := c.api().ConfigGet(ctx, serviceForFamily(family))
+	if err != nil {
+		return nil, err
+	}
+
+	var results resultErrors
+	for _, reply := range replies {
+		results.add(reply.Err())
+		config, ok := reply.Arguments[fmt.Sprintf("Dhcp%d", family)]
+		if !ok {
+			continue
+		}
+		var subnets configSubnets
+		if err := json.Unmarshal(config, &subnets); err != nil {
+			return nil, fmt.Errorf("decoding config-get: %w", err)
+		}
+		ids = append(ids, subnets.ids()...)
+	}
+	return ids, results.err()
+}
+
+// ControlAgentLeaseSource looks up leases through the lease_cmds hook.
+type ControlAgentLeaseSource struct {
+	Client ControlAgentClient
+}
+
+func (s ControlAgentLeaseSource) Name() string { return SourceControlAgentLeases }
+
+func (s ControlAgentLeaseSource) Backend() string { return s.Client.Backend }
+
+func (s ControlAgentLeaseSource) LookupName(ctx context.Context, name string) ([]Record, error) {
+	useIPv4, useIPv6 := s.Client.families(func(family int) string {
+		return fmt.Sprintf("lease%d-get-by-hostname", family)
+	})
+	return lookupFamilies(useIPv4, useIPv6, func(family int) ([]Record, error) {
+		replies, err := s.Client.api().LeaseGetByHostname(ctx, family, name, serviceForFamily(family))
+		return s.records(ctx, replies, err)
+	})
+}
+
+// List returns every lease, with lease4-get-all and lease6-get-all.
+func (s ControlAgentLeaseSource) List(ctx context.Context) ([]Record, error) {
+	useIPv4, useIPv6 := s.Client.families(func(family int) string {
+		return fmt.Sprintf("lease%d-get-all", family)
+	})
+	return lookupFamilies(useIPv4, useIPv6, func(family int) ([]Record, error) {
+		replies, err := s.Client.api().LeaseGetAll(ctx, family, serviceForFamily(family))
+		return s.records(ctx, replies, err)
+	})
+}
+
+func (s ControlAgentLeaseSource) LookupAddr(ctx context.Context, ip net.IP) (records []Record, err error) {
+	command := "lease4-get"
+	if ip.To4() == nil {
+		command = "lease6-get"
+	}
+	if !s.Client.Endpoints.Supports(serviceForIP(ip), command) {
+		return nil, nil
+	}
+	replies, err := s.Client.api().LeaseGet(ctx, ip, serviceForIP(ip))
+	if err != nil {
+		return
+	}
+
+	var results resultErrors
+	for _, reply := range replies {
+		countResult(ctx, reply.Command, reply.Result)
+		results.add(reply.Err())
+		if reply.Result == keaclient.Success {
+			records = append(records, leaseRecord(reply.Arguments, s.Client.Backend))
+		}
+	}
+	return records, results.err()
+}
+
+// LookupIdentifier returns the leases of a hardware address or client-id,
+// which are DHCPv4 only, or of a DUID, which is DHCPv6 only.
+func (s ControlAgentLeaseSource) LookupIdentifier(ctx context.Context, identifierType string, identifier string) (records []Record, err error) {
+	var replies []keaclient.Reply[keaclient.Leases]
+	switch {
+	case identifierType == IdentifierHwAddress && s.Client.UseIPv4 && s.Client.Endpoints.Supports(KEA_IPV4_SERVICE_NAME, "lease4-get-by-hw-address"):
+		replies, err = s.Client.api().LeaseGetByHwAddress(ctx, identifier, KEA_IPV4_SERVICE_NAME)
+	case identifierType == IdentifierClientID && s.Client.UseIPv4 && s.Client.Endpoints.Supports(KEA_IPV4_SERVICE_NAME, "lease4-get-by-client-id"):
+		replies, err = s.Client.api().LeaseGetByClientID(ctx, identifier, KEA_IPV4_SERVICE_NAME)
+	case identifierType == IdentifierDUID && s.Client.UseIPv6 && s.Client.Endpoints.Supports(KEA_IPV6_SERVICE_NAME, "lease6-get-by-duid"):
+		replies, err = s.Client.api().LeaseGetByDUID(ctx, identifier, KEA_IPV6_SERVICE_NAME)
+	default:
+		return nil, nil
+	}
+	return s.records(ctx, replies, err)
+}
+
+func (s ControlAgentLeaseSource) records(ctx context.Context, replies []keaclient.Reply[keaclient.Leases], err error) (records []Record, _ error) {
+	if err != nil {
+		return nil, err
+	}
+
+	var results resultErrors
+	for _, reply := range replies {
+		countResult(ctx, reply.Command, reply.Result)
+		results.add(reply.Err())
+		for _, lease := range reply.Arguments.Leases {
+			records = append(records, leaseRecord(lease, s.Client.Backend))
+		}
+	}
+	return records, results.err()
+}
+
+// ControlAgentReservationSource looks up host reservations through the
+// host_cmds hook.
+type ControlAgentReservationSource struct {
+	Client ControlAgentClient
+}
+
+func (s ControlAgentReservationSource) Name() string { return SourceControlAgentReservations }
+
+func (s ControlAgentReservationSource) Backend() string { return s.Client.Backend }
+
+func (s ControlAgentReservationSource) LookupName(ctx context.Context, name string) ([]Record, error) {
+	useIPv4, useIPv6 := s.Client.families(func(int) string { return "reservation-get-by-hostname" })
+	return lookupFamilies(useIPv4, useIPv6, func(family int) ([]Record, error) {
+		replies, err := s.Client.api().ReservationGetByHostname(ctx, name, serviceForFamily(family))
+		return s.records(ctx, replies, err)
+	})
+}
+
+func (s ControlAgentReservationSource) LookupAddr(ctx context.Context, ip net.IP) ([]Record, error) {
+	if !s.Client.Endpoints.Supports(serviceForIP(ip), "reservation-get-by-address") {
+		return nil, nil
+	}
+	replies, err := s.Client.api().ReservationGetByAddress(ctx, ip, serviceForIP(ip))
+	return s.records(ctx, replies, err)
+}
+
+// List returns every reservation, with reservation-get-all for the global
+// reservations and each subnet in the service's configuration.
+func (s ControlAgentReservationSource) List(ctx context.Context) ([]Record, error) {
+	useIPv4, useIPv6 := s.Client.families(func(int) string { return "reservation-get-all" })
+	return lookupFamilies(useIPv4, useIPv6, func(family int) (records []Record, err error) {
+		subnetIDs, err := s.Client.subnetIDs(ctx, family)
+		if err != nil {
+			return nil, err
+		}
+		for _, subnetID := range append([]int{0}, subnetIDs...) {
+			replies, err := s.Client.api().ReservationGetAll(ctx, subnetID, serviceForFamily(family))
+			found, err := s.records(ctx, replies, err)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, found...)
+		}
+		return records, nil
+	})
+}
+
+func (s ControlAgentReservationSource) records(ctx context.Context, replies []keaclient.Reply[keaclient.Hosts], err error) (records []Record, _ error) {
+	if err != nil {
+		return nil, err
+	}
+
+	var results resultErrors
+	for _, reply := range replies {
+		countResult(ctx, reply.Command, reply.Result)
+		results.add(reply.Err())
+		for _, host := range slices.Concat(reply.Arguments.Hosts, reply.Arguments.Leases) {
+			records = append(records, hostRecords(host, s.Client.Backend)...)
+		}
+	}
+	return records, results.err()
+}
+
+// countResult counts the result code of a reply to a lookup.
+func countResult(ctx context.Context, command string, result keaclient.ResultCode) {
+	apiResults.WithLabelValues(metrics.WithServer(ctx), command, result.String()).Inc()
+}
+
+// resultErrors collects the results of a command sent to several services.
+// A failure is only an error when no service answered; otherwise it is
+// logged so the answers from the other services can still be used.
+type resultErrors struct {
+	answered bool
+	failures []error
+}
+
+// add records a reply's error, or that it answered when err is nil.
+func (r *resultErrors) add(err error) {
+	if err == nil {
+		r.answered = true
+		return
+	}
+	r.failures = append(r.failures, err)
+}
+
+func (r *resultErrors) err() error {
+	if len(r.failures) == 0 {
+		return nil
+	}
+	if r.answered {
+		for _, failure := range r.failures {
+			log.Warningf("Kea error: %v", failure)
+		}
+		return nil
+	}
+	return errors.Join(r.failures...)
+}
+
+func leaseRecord(lease keaclient.Lease, backend string) Record {
+	clientID := lease.ClientID
+	if lease.DUID != "" {
+		clientID = lease.DUID
+	}
+	return Record{
+		Hostname:  lease.Hostname,
+		IP:        net.ParseIP(lease.IPAddress),
+		HwAddress: lease.HwAddress,
+		ClientID:  clientID,
+		SubnetID:  lease.SubnetID,
+		Cltt:      lease.Cltt,
+		ValidLft:  lease.ValidLft,
+		State:     lease.State,
+		Kind:      RecordKindLease,
+		Source:    SourceControlAgentLeases,
+		Backend:   backend,
+	}
+}
+
+func hostRecords(host keaclient.Host, backend string) (records []Record) {
+	ipStrings := host.IPAddresses
+	if host.IPAddress != "" {
+		ipStrings = append([]string{host.IPAddress}, ipStrings...)
+	}
+	clientID := host.ClientID
+	if host.DUID != "" {
+		clientID = host.DUID
+	}
+	for _, ipString := range ipStrings {
+		ip := net.ParseIP(ipString)
+		if ip == nil {
+			continue
+		}
+		records = append(records, Record{
+			Hostname:  host.Hostname,
+			IP:        ip,
+			HwAddress: host.HwAddress,
+			ClientID:  clientID,
+			SubnetID:  host.SubnetID,
+			Kind:      RecordKindReservation,
+			Source:    SourceControlAgentReservations,
+			Backend:   backend,
+		})
+	}
+	return
+}
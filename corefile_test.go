@@ -0,0 +1,93 @@
+package kea
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	_ "github.com/coredns/coredns/plugin/whoami"
+
+	"github.com/miekg/dns"
+)
+
+func init() {
+	// Run kea before whoami, which answers the queries it passes on.
+	i := slices.Index(dnsserver.Directives, "whoami")
+	dnsserver.Directives = slices.Insert(dnsserver.Directives, i, "kea")
+}
+
+// corefileInput is a Corefile given as a string.
+type corefileInput string
+
+func (c corefileInput) Body() []byte       { return []byte(c) }
+func (c corefileInput) Path() string       { return "Corefile" }
+func (c corefileInput) ServerType() string { return "dns" }
+
+// startCoreDNS starts a CoreDNS server and returns the UDP address it listens on.
+func startCoreDNS(t *testing.T, corefile string) string {
+	caddy.Quiet = true
+	dnsserver.Quiet = true
+	instance, err := caddy.Start(corefileInput(corefile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { instance.Stop() })
+	return instance.Servers()[0].LocalAddr().String()
+}
+
+func TestCorefile(t *testing.T) {
+	_, server := MakeTestKeaControlAgent(t)
+	address := startCoreDNS(t, fmt.Sprintf(`example.org:0 {
+		kea {
+			control_agent %s
+			extract_hostname true
+			networks 10.0.0.0/16 2001:db8::/32
+		}
+		whoami
+	}`, server.URL))
+
+	client := new(dns.Client)
+	tests := []struct {
+		qname    string
+		qtype    uint16
+		expected []string
+	}{
+		{"laptop.example.org.", dns.TypeA, []string{"10.0.0.20"}},
+		{"laptop.example.org.", dns.TypeAAAA, []string{"2001:db8:1::20"}},
+		{"nas.example.org.", dns.TypeA, []string{"10.0.0.160"}},
+		// Passed on to whoami, which answers with no records.
+		{"unknown.example.org.", dns.TypeA, nil},
+	}
+	for _, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, tc.qtype)
+		response, _, err := client.Exchange(m, address)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.qname, err)
+		}
+		if response.Rcode != dns.RcodeSuccess {
+			t.Errorf("%s: expected NOERROR, got %s", tc.qname, dns.RcodeToString[response.Rcode])
+		}
+
+		var ips []string
+		for _, rr := range response.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				ips = append(ips, rr.A.String())
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA.String())
+			}
+			if rr.Header().Ttl != 60 {
+				t.Errorf("%s: expected a TTL of 60, got %d", tc.qname, rr.Header().Ttl)
+			}
+		}
+		if !slices.Equal(ips, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.qname, tc.expected, ips)
+		}
+		if tc.expected == nil && len(response.Extra) == 0 {
+			t.Errorf("%s: expected whoami to answer", tc.qname)
+		}
+	}
+}
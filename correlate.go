@@ -0,0 +1,133 @@
+package kea
+
+import (
+	"context"
+	"encoding/hex"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// DUID types which embed a link-layer address.
+const (
+	duidLLT = 1
+	duidLL  = 3
+)
+
+// recordMAC returns the hardware address of a record's client, and where it
+// came from: the record's own hw-address, or for DHCPv6 the link-layer
+// address embedded in a DUID-LLT or DUID-LL. It is empty when neither is
+// known.
+func recordMAC(record Record) (mac string, from string) {
+	if record.HwAddress != "" {
+		return splitHex(normalizeIdentifier(record.HwAddress), ":"), IdentifierHwAddress
+	}
+	if record.IP.To4() != nil {
+		return "", ""
+	}
+	duid, err := hex.DecodeString(normalizeIdentifier(record.ClientID))
+	if err != nil || len(duid) < 4 {
+		return "", ""
+	}
+	var linkLayer []byte
+	switch int(duid[0])<<8 | int(duid[1]) {
+	case duidLLT:
+		if len(duid) > 8 {
+			linkLayer, from = duid[8:], "duid-llt"
+		}
+	case duidLL:
+		linkLayer, from = duid[4:], "duid-ll"
+	}
+	if len(linkLayer) == 0 {
+		return "", ""
+	}
+	return splitHex(hex.EncodeToString(linkLayer), ":"), from
+}
+
+// duidLLFor returns the DUID-LL an Ethernet client with the given hardware
+// address would use.
+func duidLLFor(mac string) string {
+	return "00:03:00:01:" + mac
+}
+
+// hasFamilyFor reports whether records hold an address of the family an A
+// or AAAA query asks for. It is false for other query types, which want
+// both families.
+func hasFamilyFor(records []Record, qtype uint16) bool {
+	var family int
+	switch qtype {
+	case dns.TypeA:
+		family = 4
+	case dns.TypeAAAA:
+		family = 6
+	default:
+		return false
+	}
+	return slices.ContainsFunc(records, func(r Record) bool { return recordFamily(r) == family })
+}
+
+// correlationIdentifier returns what a source is searched by for the other
+// family's records of a client with the given hardware address. Kea's
+// control API only finds DHCPv4 leases by hardware address, and DHCPv6
+// leases by DUID, so from DHCPv4 records it is given the DUID-LL the client
+// would use. Other sources match hardware addresses in DHCPv6 records,
+// including those embedded in a DUID-LLT or DUID-LL.
+func correlationIdentifier(source Source, fromIPv4 bool, mac string) (identifierType string, identifier string) {
+	if _, ok := source.(ControlAgentLeaseSource); ok && fromIPv4 {
+		return IdentifierDUID, duidLLFor(mac)
+	}
+	return IdentifierHwAddress, mac
+}
+
+// correlate adds, to a hostname's records of one address family, the
+// records of the other family held by the same client, identified by its
+// hardware address. Records of the other family with a different hostname
+// are left out. Each added record carries the association in CorrelatedBy.
+// Lookup failures are logged, and the records found so far are returned.
+func (k Kea) correlate(ctx context.Context, records []Record) []Record {
+	families := map[int]bool{}
+	for _, record := range records {
+		families[recordFamily(record)] = true
+	}
+	if len(families) != 1 {
+		return records
+	}
+
+	var tried []string
+	correlated := slices.Clone(records)
+	for _, record := range records {
+		mac, from := recordMAC(record)
+		if mac == "" || slices.Contains(tried, mac) {
+			continue
+		}
+		tried = append(tried, mac)
+
+		candidates, err := k.lookup(ctx, func(ctx context.Context, source Source) ([]Record, error) {
+			identifierSource, ok := source.(IdentifierSource)
+			if !ok {
+				return nil, nil
+			}
+			identifierType, identifier := correlationIdentifier(source, families[4], mac)
+			return identifierSource.LookupIdentifier(ctx, identifierType, identifier)
+		})
+		if err != nil {
+			log.Warningf("Failed to correlate %s by %s: %v", record.Hostname, mac, err)
+			continue
+		}
+
+		for _, candidate := range candidates {
+			candidateMAC, candidateFrom := recordMAC(candidate)
+			if families[recordFamily(candidate)] || candidateMAC != mac || containsIP(correlated, candidate) {
+				continue
+			}
+			if candidate.Hostname != "" && !HostnameMatches(candidate.Hostname, record.Hostname) {
+				continue
+			}
+			candidate.Hostname = record.Hostname
+			candidate.CorrelatedBy = record.IP.String() + " by " + mac + " (" + from + ", " + candidateFrom + ")"
+			log.Debugf("Correlated %s with %s: %s", candidate.IP, record.Hostname, candidate.CorrelatedBy)
+			correlated = append(correlated, candidate)
+		}
+	}
+	return correlated
+}
@@ -0,0 +1,184 @@
+package kea
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/ionothanus/coredns-kea/keaclient"
+	"github.com/ionothanus/coredns-kea/keatest"
+
+	"github.com/miekg/dns"
+)
+
+func TestRecordMAC(t *testing.T) {
+	tests := []struct {
+		record Record
+		mac    string
+		from   string
+	}{
+		{Record{IP: net.ParseIP("10.0.0.20"), HwAddress: "00:11:22:33:44:66"}, "00:11:22:33:44:66", IdentifierHwAddress},
+		{Record{IP: net.ParseIP("10.0.0.20"), ClientID: "01:00:11:22:33:44:66"}, "", ""},
+		{Record{IP: net.ParseIP("2001:db8:1::20"), ClientID: "00:03:00:01:00:11:22:33:44:66"}, "00:11:22:33:44:66", "duid-ll"},
+		{Record{IP: net.ParseIP("2001:db8:1::20"), ClientID: "00:01:00:01:2c:3d:4e:5f:00:11:22:33:44:66"}, "00:11:22:33:44:66", "duid-llt"},
+		{Record{IP: net.ParseIP("2001:db8:1::20"), ClientID: "00:02:00:00:09:bf:01:02:03:04"}, "", ""},
+		{Record{IP: net.ParseIP("2001:db8:1::20"), ClientID: "00:01:00:01"}, "", ""},
+	}
+	for i, tc := range tests {
+		mac, from := recordMAC(tc.record)
+		if mac != tc.mac || from != tc.from {
+			t.Errorf("Test %d: expected %q from %q, got %q from %q", i, tc.mac, tc.from, mac, from)
+		}
+	}
+}
+
+func TestServeCorrelated(t *testing.T) {
+	fixture := testFixture(t)
+	fixture.Leases = append(fixture.Leases,
+		// The TV only sends its hostname over DHCPv4, and uses a DUID-LL.
+		keaclient.Lease{IPAddress: "10.0.0.40", HwAddress: "00:11:22:33:44:aa", Hostname: "tv", SubnetID: 1, Cltt: 1700000000, ValidLft: 3600},
+		keaclient.Lease{IPAddress: "2001:db8:1::40", DUID: "00:03:00:01:00:11:22:33:44:aa", SubnetID: 1, Cltt: 1700000000, ValidLft: 3600},
+		// The phone only sends it over DHCPv6, and uses a DUID-LLT.
+		keaclient.Lease{IPAddress: "10.0.0.50", HwAddress: "00:11:22:33:44:bb", SubnetID: 1, Cltt: 1700000000, ValidLft: 3600},
+		keaclient.Lease{IPAddress: "2001:db8:1::50", DUID: "00:01:00:01:2c:3d:4e:5f:00:11:22:33:44:bb", Hostname: "phone", SubnetID: 1, Cltt: 1700000000, ValidLft: 3600},
+		// A lease with the printer's hardware address under another name
+		// isn't published as the printer's.
+		keaclient.Lease{IPAddress: "2001:db8:1::60", DUID: "00:03:00:01:00:11:22:33:44:77", Hostname: "scanner", SubnetID: 1, Cltt: 1700000000, ValidLft: 3600},
+	)
+	server := keatest.NewControlAgent(t, fixture)
+
+	kea := Kea{
+		ControlAgents:            []string{server.URL},
+		ControlAgentLeases:       "true",
+		ControlAgentReservations: "true",
+		UseIPv4:                  "true",
+		UseIPv6:                  "true",
+		ExtractHostname:          "true",
+		CorrelateFamilies:        "true",
+		TXTClients:               []string{"10.240.0.0/16"},
+		Next:                     fallthroughHandler(),
+	}
+
+	disabled := kea
+	disabled.CorrelateFamilies = "false"
+
+	tests := []struct {
+		kea      Kea
+		qname    string
+		qtype    uint16
+		rcode    int
+		expected []string
+	}{
+		{kea, "tv.lan.", dns.TypeAAAA, dns.RcodeSuccess, []string{"tv.lan.	60	IN	AAAA	2001:db8:1::40"}},
+		{kea, "tv.lan.", dns.TypeTXT, dns.RcodeSuccess, []string{
+			`tv.lan.	0	IN	TXT	"address=10.0.0.40" "source=lease" "hw-address=00:11:22:33:44:aa" "subnet-id=1" "state=default" "start=2023-11-14T22:13:20Z" "expiry=2023-11-14T23:13:20Z"`,
+			`tv.lan.	0	IN	TXT	"address=2001:db8:1::40" "source=lease" "duid=00:03:00:01:00:11:22:33:44:aa" "subnet-id=1" "correlated=10.0.0.40 by 00:11:22:33:44:aa (hw-address, duid-ll)" "state=default" "start=2023-11-14T22:13:20Z" "expiry=2023-11-14T23:13:20Z"`,
+		}},
+		{kea, "phone.lan.", dns.TypeA, dns.RcodeSuccess, []string{"phone.lan.	60	IN	A	10.0.0.50"}},
+		{kea, "printer.lan.", dns.TypeAAAA, dns.RcodeNameError, nil},
+		{disabled, "tv.lan.", dns.TypeAAAA, dns.RcodeNameError, nil},
+		{disabled, "phone.lan.", dns.TypeA, dns.RcodeNameError, nil},
+	}
+
+	for i, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, tc.qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, err := tc.kea.ServeDNS(context.Background(), rec, m)
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if rcode != tc.rcode {
+			t.Errorf("Test %d: expected rcode %s, got %s", i, dns.RcodeToString[tc.rcode], dns.RcodeToString[rcode])
+		}
+		if len(rec.Msg.Answer) != len(tc.expected) {
+			t.Errorf("Test %d: expected %d answers, got %v", i, len(tc.expected), rec.Msg.Answer)
+			continue
+		}
+		for j, rr := range rec.Msg.Answer {
+			if rr.String() != tc.expected[j] {
+				t.Errorf("Test %d: expected\n%s\ngot\n%s", i, tc.expected[j], rr)
+			}
+		}
+	}
+}
+
+func TestCorrelateOnlyMissingFamily(t *testing.T) {
+	fixture := testFixture(t)
+	fixture.Leases = append(fixture.Leases,
+		keaclient.Lease{IPAddress: "10.0.0.40", HwAddress: "00:11:22:33:44:aa", Hostname: "tv", SubnetID: 1, Cltt: 1700000000, ValidLft: 3600},
+		keaclient.Lease{IPAddress: "2001:db8:1::40", DUID: "00:03:00:01:00:11:22:33:44:aa", SubnetID: 1, Cltt: 1700000000, ValidLft: 3600},
+	)
+	server := keatest.NewControlAgent(t, fixture)
+	kea := Kea{
+		ControlAgents:      []string{server.URL},
+		ControlAgentLeases: "true",
+		UseIPv4:            "true",
+		UseIPv6:            "true",
+		CorrelateFamilies:  "true",
+	}
+
+	tests := []struct {
+		qtype    uint16
+		expected []string
+	}{
+		// The A query is answered from the lease already found.
+		{dns.TypeA, nil},
+		// lease4-get-by-hw-address would only find the DHCPv4 lease again.
+		{dns.TypeAAAA, []string{"lease6-get-by-duid"}},
+	}
+	for i, tc := range tests {
+		before := len(server.Sent())
+		if _, err := kea.LookupNameFor(context.Background(), "tv", tc.qtype); err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		var sent []string
+		for _, command := range server.Sent()[before:] {
+			if command != "lease4-get-by-hostname" && command != "lease6-get-by-hostname" {
+				sent = append(sent, command)
+			}
+		}
+		if !slices.Equal(sent, tc.expected) {
+			t.Errorf("Test %d: expected %v to be sent, got %v", i, tc.expected, sent)
+		}
+	}
+}
+
+func TestCorrelateLeaseFilesByDUIDLLT(t *testing.T) {
+	// The phone only sends its hostname over DHCPv4, and uses a DUID-LLT
+	// without Kea recording its hardware address.
+	dir := t.TempDir()
+	lease4Path := filepath.Join(dir, "kea-leases4.csv")
+	lease6Path := filepath.Join(dir, "kea-leases6.csv")
+	writeLeaseFile(t, lease4Path, testLeases4Header+
+		"10.0.0.50,00:11:22:33:44:bb,,3600,4102444800,1,0,0,phone,0,,0\n")
+	writeLeaseFile(t, lease6Path, "address,duid,valid_lifetime,expire,subnet_id,pref_lifetime,lease_type,iaid,prefix_len,fqdn_fwd,fqdn_rev,hostname,hwaddr,state,user_context,hwtype,hwaddr_source,pool_id\n"+
+		"2001:db8:1::50,00:01:00:01:2c:3d:4e:5f:00:11:22:33:44:bb,3600,4102444800,1,3000,0,1,128,0,0,,,0,,1,0,0\n")
+
+	kea := Kea{
+		Lease4File:        NewLeaseFile(lease4Path),
+		Lease6File:        NewLeaseFile(lease6Path),
+		CorrelateFamilies: "true",
+	}
+	for _, leaseFile := range []*LeaseFile{kea.Lease4File, kea.Lease6File} {
+		if err := leaseFile.Load(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := kea.LookupNameFor(context.Background(), "phone", dns.TypeAAAA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips := RecordIPs(records); len(ips) != 2 || ips[1].String() != "2001:db8:1::50" {
+		t.Fatalf("expected the DHCPv6 lease to be correlated, got %v", ips)
+	}
+	if expected := "10.0.0.50 by 00:11:22:33:44:bb (hw-address, duid-llt)"; records[1].CorrelatedBy != expected {
+		t.Errorf("expected %q, got %q", expected, records[1].CorrelatedBy)
+	}
+}
@@ -0,0 +1,171 @@
+package kea
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ionothanus/coredns-kea/keaclient"
+)
+
+// How often each endpoint's capabilities are rediscovered, and how long
+// discovery may take.
+const discoveryInterval = 5 * time.Minute
+const discoveryTimeout = 10 * time.Second
+
+// Request formats an endpoint can accept.
+const (
+	// FormatControlAgent is the Kea control agent, which forwards commands to
+	// the daemons named in "service" and answers with a list of responses.
+	FormatControlAgent = "control_agent"
+	// FormatDirect is a daemon's own HTTP control socket (Kea 3.0 and later),
+	// which takes commands without "service" and answers with one response.
+	FormatDirect = "direct"
+)
+
+// Capabilities records what each service behind an endpoint supports.
+type Capabilities struct {
+	Format   string
+	Versions map[string]string
+	Commands map[string][]string
+	// Errors holds the reason a service's commands couldn't be listed.
+	Errors map[string]string
+}
+
+// Supports reports whether a service has a command available.
+func (c *Capabilities) Supports(service string, command string) bool {
+	return slices.Contains(c.Commands[service], command)
+}
+
+func (c *Capabilities) String() string {
+	var services []string
+	for _, service := range slices.Sorted(maps.Keys(c.Commands)) {
+		var hooks []string
+		if c.Supports(service, "lease4-get-by-hostname") || c.Supports(service, "lease6-get-by-hostname") {
+			hooks = append(hooks, "leases")
+		}
+		if c.Supports(service, "reservation-get-by-hostname") {
+			hooks = append(hooks, "reservations")
+		}
+		if len(hooks) == 0 {
+			hooks = append(hooks, "no lookups")
+		}
+		services = append(services, fmt.Sprintf("%s %s (%s)", service, c.Versions[service], strings.Join(hooks, ", ")))
+	}
+	for _, service := range slices.Sorted(maps.Keys(c.Errors)) {
+		services = append(services, fmt.Sprintf("%s unavailable: %s", service, c.Errors[service]))
+	}
+	return c.Format + ": " + strings.Join(services, "; ")
+}
+
+// Discover finds out whether the endpoint is a control agent or a daemon,
+// which commands each service supports and which version each runs.
+func (e *Endpoint) Discover(ctx context.Context) (*Capabilities, error) {
+	capabilities := &Capabilities{
+		Versions: map[string]string{},
+		Commands: map[string][]string{},
+		Errors:   map[string]string{},
+	}
+
+	serviceList := e.Services
+	command := keaclient.Command{Command: "list-commands", Service: serviceList}
+	requestBody, err := keaclient.Encode(command)
+	if err != nil {
+		return nil, err
+	}
+	responseBody, err := e.post(ctx, requestBody)
+	if err != nil {
+		return nil, err
+	}
+
+	if trimmed := bytes.TrimSpace(responseBody); len(trimmed) > 0 && trimmed[0] == '[' {
+		capabilities.Format = FormatControlAgent
+	} else {
+		capabilities.Format = FormatDirect
+		command.Service = nil
+		requestBody, err = keaclient.Encode(command)
+		if err != nil {
+			return nil, err
+		}
+		responseBody, err = e.post(ctx, requestBody)
+		if err != nil {
+			return nil, err
+		}
+		service, err := e.directService(ctx)
+		if err != nil {
+			return nil, err
+		}
+		serviceList = []string{service}
+	}
+
+	commands, err := keaclient.Decode[[]string](command, responseBody)
+	if err != nil {
+		return nil, err
+	}
+	for i, reply := range commands {
+		if i >= len(serviceList) {
+			break
+		}
+		if reply.Result == keaclient.Success {
+			capabilities.Commands[serviceList[i]] = reply.Arguments
+		} else {
+			capabilities.Errors[serviceList[i]] = reply.Text
+		}
+	}
+
+	versions, err := e.rawClient().VersionGet(ctx, command.Service...)
+	if err != nil {
+		return nil, err
+	}
+	for i, reply := range versions {
+		if i < len(serviceList) && reply.Result == keaclient.Success {
+			capabilities.Versions[serviceList[i]] = reply.Text
+		}
+	}
+
+	return capabilities, nil
+}
+
+// directService uses config-get to find out which daemon a direct endpoint is.
+func (e *Endpoint) directService(ctx context.Context) (string, error) {
+	config, err := e.rawClient().ConfigGet(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(config) == 0 {
+		return "", errors.New("config-get returned no response")
+	}
+	if err = config[0].Err(); err != nil {
+		return "", err
+	}
+	if _, ok := config[0].Arguments["Dhcp4"]; ok {
+		return KEA_IPV4_SERVICE_NAME, nil
+	}
+	if _, ok := config[0].Arguments["Dhcp6"]; ok {
+		return KEA_IPV6_SERVICE_NAME, nil
+	}
+	return "", errors.New("endpoint is neither a control agent nor a DHCP daemon")
+}
+
+// refresh runs discovery and logs the outcome when it changes.
+func (e *Endpoint) refresh(ctx context.Context) error {
+	capabilities, err := e.Discover(ctx)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	previous := e.capabilities
+	e.capabilities = capabilities
+	e.mu.Unlock()
+
+	if previous == nil || previous.String() != capabilities.String() {
+		log.Infof("Discovered Kea at %s as %s", e.URL, capabilities)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package kea
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ionothanus/coredns-kea/keatest"
+)
+
+// newLimitedControlAgent starts a fake control agent with dhcp4 running
+// lease_cmds only and dhcp6 down.
+func newLimitedControlAgent(t *testing.T) *keatest.Server {
+	server := keatest.NewControlAgent(t, testFixture(t))
+	server.Services = []string{keatest.DHCP4}
+	server.RemoveCommands("reservation-get-by-hostname", "reservation-get-by-address")
+	return server
+}
+
+func TestDiscoverControlAgent(t *testing.T) {
+	server := newLimitedControlAgent(t)
+
+	endpoint := NewEndpoint(server.URL, false, []string{KEA_IPV4_SERVICE_NAME, KEA_IPV6_SERVICE_NAME})
+	if err := endpoint.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	capabilities := endpoint.Capabilities()
+	if capabilities == nil {
+		t.Fatal("expected discovery to succeed")
+	}
+	if capabilities.Format != FormatControlAgent {
+		t.Errorf("expected control agent format, got %s", capabilities.Format)
+	}
+	if capabilities.Versions[KEA_IPV4_SERVICE_NAME] != "2.6.1" {
+		t.Errorf("unexpected versions %v", capabilities.Versions)
+	}
+	if !endpoint.Supports(KEA_IPV4_SERVICE_NAME, "lease4-get-by-hostname") {
+		t.Error("expected dhcp4 to support lease lookups")
+	}
+	if endpoint.Supports(KEA_IPV4_SERVICE_NAME, "reservation-get-by-hostname") {
+		t.Error("expected dhcp4 not to support reservation lookups")
+	}
+	if endpoint.Supports(KEA_IPV6_SERVICE_NAME, "lease6-get-by-hostname") {
+		t.Error("expected dhcp6 to be unavailable")
+	}
+
+	// Reservation lookups and IPv6 lookups are skipped rather than failing.
+	kea := Kea{
+		Endpoints:                &EndpointPool{Endpoints: []*Endpoint{endpoint}},
+		ControlAgentLeases:       "true",
+		ControlAgentReservations: "true",
+		UseIPv4:                  "true",
+		UseIPv6:                  "true",
+	}
+	before := len(server.Sent())
+	if _, err := kea.LookupName(context.Background(), "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	sent := server.Sent()[before:]
+	if len(sent) != 1 || sent[0] != "lease4-get-by-hostname" {
+		t.Errorf("expected only lease4-get-by-hostname to be sent, got %v", sent)
+	}
+}
+
+func TestDiscoverDirect(t *testing.T) {
+	server := keatest.NewDirect(t, keatest.DHCP6, testFixture(t))
+	server.Version = "3.0.0"
+
+	endpoint := NewEndpoint(server.URL, false, []string{KEA_IPV4_SERVICE_NAME, KEA_IPV6_SERVICE_NAME})
+	if err := endpoint.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	capabilities := endpoint.Capabilities()
+	if capabilities == nil {
+		t.Fatal("expected discovery to succeed")
+	}
+	if capabilities.Format != FormatDirect {
+		t.Errorf("expected direct format, got %s", capabilities.Format)
+	}
+	if capabilities.Versions[KEA_IPV6_SERVICE_NAME] != "3.0.0" {
+		t.Errorf("unexpected versions %v", capabilities.Versions)
+	}
+	if endpoint.Supports(KEA_IPV4_SERVICE_NAME, "lease4-get-by-hostname") {
+		t.Error("expected a dhcp6 socket not to serve dhcp4")
+	}
+
+	kea := Kea{
+		Endpoints:                &EndpointPool{Endpoints: []*Endpoint{endpoint}},
+		ControlAgentLeases:       "true",
+		ControlAgentReservations: "true",
+		UseIPv4:                  "true",
+		UseIPv6:                  "true",
+	}
+	before := len(server.Sent())
+	if _, err := kea.LookupName(context.Background(), "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if sent := server.Sent()[before:]; len(sent) != 2 {
+		t.Errorf("expected lease6 and reservation lookups, got %v", sent)
+	}
+}
+
+func TestEndpointSupportsBeforeDiscovery(t *testing.T) {
+	endpoint := NewEndpoint("http://127.0.0.1:1", false, []string{KEA_IPV4_SERVICE_NAME})
+	if err := endpoint.refresh(context.Background()); err == nil {
+		t.Fatal("expected discovery to fail")
+	}
+	if !endpoint.Supports(KEA_IPV4_SERVICE_NAME, "reservation-get-by-hostname") {
+		t.Error("expected every command to be assumed supported until discovery succeeds")
+	}
+}
@@ -0,0 +1,250 @@
+package kea
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ionothanus/coredns-kea/keaclient"
+)
+
+// How often each endpoint is checked with status-get.
+const healthCheckInterval = 10 * time.Second
+
+// Endpoint is a URL Kea accepts commands on, either the control agent or a
+// daemon's HTTP control socket, along with what it was discovered to support.
+type Endpoint struct {
+	URL      string
+	Insecure bool
+	Services []string
+	// HAHeartbeat makes the health checks also send ha-heartbeat, so an
+	// EndpointPool can prefer the server that is serving clients.
+	HAHeartbeat bool
+
+	mu           sync.RWMutex
+	capabilities *Capabilities
+	failures     int
+	retryAt      time.Time
+	haState      string
+	haServing    bool
+
+	// Only used by the goroutine started by Start.
+	discovered time.Time
+	checked    bool
+
+	healthy atomic.Bool
+	reached atomic.Bool
+
+	loop loop
+}
+
+func NewEndpoint(url string, insecure bool, services []string) *Endpoint {
+	return &Endpoint{URL: url, Insecure: insecure, Services: services}
+}
+
+func (e *Endpoint) httpClient() *http.Client {
+	if e.Insecure {
+		transCfg := &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		return &http.Client{Transport: transCfg}
+	}
+	return &http.Client{}
+}
+
+// Capabilities returns what was last discovered, or nil if discovery
+// hasn't succeeded yet.
+func (e *Endpoint) Capabilities() *Capabilities {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.capabilities
+}
+
+// Supports reports whether a service is known to support a command. Until
+// discovery has succeeded every command is assumed to be supported.
+func (e *Endpoint) Supports(service string, command string) bool {
+	capabilities := e.Capabilities()
+	return capabilities == nil || capabilities.Supports(service, command)
+}
+
+// Request sends a command written in the control agent format, adapting it
+// and the response when the endpoint is a daemon's own control socket.
+func (e *Endpoint) Request(ctx context.Context, requestBody string) (responseBody []byte, err error) {
+	capabilities := e.Capabilities()
+	if capabilities == nil || capabilities.Format != FormatDirect {
+		return e.post(ctx, requestBody)
+	}
+
+	var command map[string]json.RawMessage
+	if err = json.Unmarshal([]byte(requestBody), &command); err != nil {
+		return
+	}
+	delete(command, "service")
+	directBody, err := json.Marshal(command)
+	if err != nil {
+		return
+	}
+
+	responseBody, err = e.post(ctx, string(directBody))
+	if err != nil {
+		return
+	}
+	return asResponseList(responseBody), nil
+}
+
+func (e *Endpoint) post(ctx context.Context, requestBody string) (responseBody []byte, err error) {
+	if path, ok := strings.CutPrefix(e.URL, "unix://"); ok {
+		return postUnix(ctx, path, requestBody)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.URL, bytes.NewBufferString(requestBody))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.httpClient().Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errors.New(resp.Status)
+		return
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+
+	return body, nil
+}
+
+// postUnix sends a command to a daemon's UNIX control socket, which answers
+// and closes the connection.
+func postUnix(ctx context.Context, path string, requestBody string) (responseBody []byte, err error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", path)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if _, err = io.WriteString(conn, requestBody); err != nil {
+		return
+	}
+	return io.ReadAll(conn)
+}
+
+// asResponseList wraps a single response object in a list, so direct and
+// control agent responses decode the same way.
+func asResponseList(body []byte) []byte {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return slices.Concat([]byte("["), trimmed, []byte("]"))
+	}
+	return body
+}
+
+// rawClient sends commands to the endpoint as they are, bypassing the
+// adaptation Request does, for commands which already know the format.
+func (e *Endpoint) rawClient() keaclient.Client {
+	return keaclient.Client{Transport: keaclient.TransportFunc(e.post)}
+}
+
+// commandServices returns the services to name in a command: none for a
+// daemon's own control socket.
+func (e *Endpoint) commandServices() []string {
+	if capabilities := e.Capabilities(); capabilities != nil && capabilities.Format == FormatDirect {
+		return nil
+	}
+	return e.Services
+}
+
+// CheckStatus sends status-get to the endpoint's services. The endpoint is
+// healthy when at least one of them answers successfully.
+func (e *Endpoint) CheckStatus(ctx context.Context) error {
+	statuses, err := e.rawClient().StatusGet(ctx, e.commandServices()...)
+	if err != nil {
+		return err
+	}
+	var failures []error
+	for _, status := range statuses {
+		if status.Result == keaclient.Success {
+			return nil
+		}
+		failures = append(failures, status.Err())
+	}
+	if len(failures) == 0 {
+		return errors.New("status-get returned no response")
+	}
+	return errors.Join(failures...)
+}
+
+// Healthy reports whether the endpoint answered its last status check.
+func (e *Endpoint) Healthy() bool { return e.healthy.Load() }
+
+// Reached reports whether the endpoint has ever answered a status check.
+func (e *Endpoint) Reached() bool { return e.reached.Load() }
+
+// check rediscovers the endpoint's capabilities when they are unknown or out
+// of date, so the right request format is used, then runs a status check and
+// records the result. Failures are logged when the endpoint's health changes.
+func (e *Endpoint) check(ctx context.Context) {
+	wasHealthy := e.healthy.Load()
+
+	if e.Capabilities() == nil || time.Since(e.discovered) >= discoveryInterval {
+		if err := e.refresh(ctx); err != nil && (wasHealthy || !e.checked) {
+			log.Warningf("Failed to discover Kea capabilities at %s: %v", e.URL, err)
+		}
+		e.discovered = time.Now()
+	}
+
+	err := e.CheckStatus(ctx)
+	healthy := err == nil
+	if healthy != wasHealthy || !e.checked {
+		if healthy {
+			log.Infof("Kea at %s is reachable", e.URL)
+		} else {
+			log.Warningf("Kea at %s is unreachable: %v", e.URL, err)
+		}
+	}
+	if e.HAHeartbeat && healthy {
+		e.checkHA(ctx)
+	} else if e.HAHeartbeat {
+		e.mu.Lock()
+		e.haState, e.haServing = "", false
+		e.mu.Unlock()
+	}
+	e.checked = true
+	e.healthy.Store(healthy)
+	if healthy {
+		e.reached.Store(true)
+		endpointHealthy.WithLabelValues(e.URL).Set(1)
+	} else {
+		endpointHealthy.WithLabelValues(e.URL).Set(0)
+	}
+}
+
+// Start checks the endpoint's health and discovers its capabilities now,
+// and then periodically.
+func (e *Endpoint) Start() {
+	e.loop.start(healthCheckInterval, discoveryTimeout, true, e.check)
+}
+
+// Stop ends the checks started by Start.
+func (e *Endpoint) Stop() {
+	e.loop.stop()
+}
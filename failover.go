@@ -0,0 +1,248 @@
+package kea
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/ionothanus/coredns-kea/keaclient"
+)
+
+// How long an endpoint is skipped after a failed request. The delay doubles
+// with each consecutive failure, up to the maximum.
+const endpointBackoffMin = time.Second
+const endpointBackoffMax = 30 * time.Second
+
+// HA states in which a server with scopes answers DHCP clients, so its leases
+// are authoritative.
+var haServingStates = []string{"hot-standby", "load-balancing", "partner-down"}
+
+// ErrNoEndpoints is returned by a pool without any endpoints.
+var ErrNoEndpoints = errors.New("no Kea endpoints configured")
+
+// EndpointPool sends each command to one of several endpoints, such as the
+// control agents of a Kea HA pair, failing over to the next one on errors.
+type EndpointPool struct {
+	Endpoints []*Endpoint
+	// Guard, if set, limits the requests sent through the pool.
+	Guard *RequestGuard
+}
+
+func NewEndpointPool(urls []string, insecure bool, services []string, haHeartbeat bool) *EndpointPool {
+	pool := &EndpointPool{}
+	for _, url := range urls {
+		endpoint := NewEndpoint(url, insecure, services)
+		endpoint.HAHeartbeat = haHeartbeat
+		pool.Endpoints = append(pool.Endpoints, endpoint)
+	}
+	return pool
+}
+
+// Supports reports whether any endpoint may support a command.
+func (p *EndpointPool) Supports(service string, command string) bool {
+	for _, endpoint := range p.Endpoints {
+		if endpoint.Supports(service, command) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reached reports whether any endpoint has answered a status check.
+func (p *EndpointPool) Reached() bool {
+	for _, endpoint := range p.Endpoints {
+		if endpoint.Reached() {
+			return true
+		}
+	}
+	return false
+}
+
+// candidates returns the endpoints to try for a command, in order: those
+// serving clients according to ha-heartbeat, then healthy ones, then
+// unhealthy ones, and last those backing off after a failure. Endpoints
+// known not to support the command are left out, unless none does.
+func (p *EndpointPool) candidates(command string, services []string, now time.Time) []*Endpoint {
+	var serving, healthy, unhealthy, backingOff []*Endpoint
+	for _, endpoint := range p.Endpoints {
+		supported := len(services) == 0
+		for _, service := range services {
+			supported = supported || endpoint.Supports(service, command)
+		}
+		if !supported {
+			continue
+		}
+		switch {
+		case endpoint.backingOff(now):
+			backingOff = append(backingOff, endpoint)
+		case endpoint.HAHeartbeat && endpoint.Serving():
+			serving = append(serving, endpoint)
+		case endpoint.Healthy():
+			healthy = append(healthy, endpoint)
+		default:
+			unhealthy = append(unhealthy, endpoint)
+		}
+	}
+	candidates := slices.Concat(serving, healthy, unhealthy, backingOff)
+	if len(candidates) == 0 {
+		return p.Endpoints
+	}
+	return candidates
+}
+
+// Request sends a command to the first candidate endpoint that answers it.
+// Only transport and HTTP errors fail over; a Kea error result is an answer.
+// When every endpoint fails, the request counts towards the Guard's circuit
+// breaker.
+func (p *EndpointPool) Request(ctx context.Context, requestBody string) (responseBody []byte, err error) {
+	if len(p.Endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	var command keaclient.Command
+	if err = json.Unmarshal([]byte(requestBody), &command); err != nil {
+		return
+	}
+
+	if p.Guard != nil && !isBackground(ctx) {
+		if err = p.Guard.Acquire(ctx); err != nil {
+			return
+		}
+		defer func() { p.Guard.Done(ctx, err) }()
+	}
+
+	var errs []error
+	for _, endpoint := range p.candidates(command.Command, command.Service, time.Now()) {
+		start := time.Now()
+		span, spanCtx := startSpan(ctx, "kea.request")
+		responseBody, err = endpoint.Request(spanCtx, requestBody)
+		apiRequestDuration.WithLabelValues(metrics.WithServer(ctx), command.Command, endpoint.URL).Observe(time.Since(start).Seconds())
+		finishRequestSpan(span, command, endpoint, responseBody, err)
+		if err == nil {
+			endpoint.succeeded()
+			return responseBody, nil
+		}
+		if ctx.Err() != nil {
+			// The query ran out of time; that isn't the endpoint's fault.
+			return nil, err
+		}
+		endpoint.failed(err)
+		errs = append(errs, fmt.Errorf("%s: %w", endpoint.URL, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Start starts every endpoint's health checks.
+func (p *EndpointPool) Start() {
+	for _, endpoint := range p.Endpoints {
+		endpoint.Start()
+	}
+}
+
+// Stop ends every endpoint's health checks.
+func (p *EndpointPool) Stop() {
+	for _, endpoint := range p.Endpoints {
+		endpoint.Stop()
+	}
+}
+
+func (e *Endpoint) backingOff(now time.Time) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return now.Before(e.retryAt)
+}
+
+// failed backs the endpoint off after a failed request.
+func (e *Endpoint) failed(err error) {
+	e.mu.Lock()
+	e.failures++
+	backoff := endpointBackoffMax
+	if e.failures <= 5 {
+		backoff = min(endpointBackoffMin<<(e.failures-1), endpointBackoffMax)
+	}
+	e.retryAt = time.Now().Add(backoff)
+	failures := e.failures
+	e.mu.Unlock()
+
+	if failures == 1 {
+		log.Warningf("Request to Kea at %s failed, failing over: %v", e.URL, err)
+	}
+}
+
+// succeeded clears the endpoint's backoff after a successful request.
+func (e *Endpoint) succeeded() {
+	e.mu.Lock()
+	failures := e.failures
+	e.failures = 0
+	e.retryAt = time.Time{}
+	e.mu.Unlock()
+
+	if failures > 0 {
+		log.Infof("Requests to Kea at %s succeed again", e.URL)
+	}
+}
+
+// Serving reports whether ha-heartbeat last showed the endpoint serving
+// clients in an HA state that makes its leases authoritative.
+func (e *Endpoint) Serving() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.haServing
+}
+
+// Heartbeat sends ha-heartbeat to the endpoint's services and reports their
+// HA state, and whether one of them is serving clients.
+func (e *Endpoint) Heartbeat(ctx context.Context) (state string, serving bool, err error) {
+	heartbeats, err := e.rawClient().HAHeartbeat(ctx, e.commandServices()...)
+	if err != nil {
+		return
+	}
+	var failures []error
+	for _, heartbeat := range heartbeats {
+		if heartbeat.Result != keaclient.Success {
+			failures = append(failures, heartbeat.Err())
+			continue
+		}
+		if state == "" || !serving {
+			state = heartbeat.Arguments.State
+		}
+		if slices.Contains(haServingStates, heartbeat.Arguments.State) && len(heartbeat.Arguments.Scopes) > 0 {
+			serving = true
+		}
+	}
+	if state == "" {
+		err = errors.Join(failures...)
+		if err == nil {
+			err = errors.New("ha-heartbeat returned no state")
+		}
+	}
+	return
+}
+
+// checkHA records the endpoint's HA state, logging it when it changes or on
+// the first check.
+func (e *Endpoint) checkHA(ctx context.Context) {
+	state, serving, err := e.Heartbeat(ctx)
+	if err != nil {
+		state = ""
+	}
+
+	e.mu.Lock()
+	changed := state != e.haState || serving != e.haServing
+	e.haState = state
+	e.haServing = serving
+	e.mu.Unlock()
+
+	switch {
+	case !changed && e.checked:
+	case err != nil:
+		log.Warningf("Failed to get the HA state of Kea at %s: %v", e.URL, err)
+	case serving:
+		log.Infof("Kea at %s is in HA state %s and serving clients", e.URL, state)
+	default:
+		log.Infof("Kea at %s is in HA state %s and not serving clients", e.URL, state)
+	}
+}
@@ -0,0 +1,136 @@
+package kea
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ionothanus/coredns-kea/keaclient"
+	"github.com/ionothanus/coredns-kea/keatest"
+)
+
+func makeTestPool(t *testing.T, haHeartbeat bool, servers ...*keatest.Server) *EndpointPool {
+	var urls []string
+	for _, server := range servers {
+		urls = append(urls, server.URL)
+	}
+	return NewEndpointPool(urls, false, []string{KEA_IPV4_SERVICE_NAME, KEA_IPV6_SERVICE_NAME}, haHeartbeat)
+}
+
+func makeTestPoolKea(pool *EndpointPool) Kea {
+	return Kea{
+		Endpoints:          pool,
+		ControlAgentLeases: "true",
+		UseIPv4:            "true",
+		UseIPv6:            "true",
+	}
+}
+
+func TestEndpointPoolFailover(t *testing.T) {
+	primary := newLimitedControlAgent(t)
+	secondary := newLimitedControlAgent(t)
+	pool := makeTestPool(t, false, primary, secondary)
+	for _, endpoint := range pool.Endpoints {
+		endpoint.check(context.Background())
+	}
+	primary.Inject(keatest.Fault{HTTPStatus: http.StatusServiceUnavailable})
+
+	kea := makeTestPoolKea(pool)
+	if _, err := kea.LookupName(context.Background(), "laptop"); err != nil {
+		t.Fatalf("expected the secondary to answer, got %v", err)
+	}
+	if !slices.Contains(secondary.Sent(), "lease4-get-by-hostname") {
+		t.Errorf("expected the lookup to fail over, secondary got %v", secondary.Sent())
+	}
+	if !pool.Endpoints[0].backingOff(time.Now()) {
+		t.Error("expected the primary to back off")
+	}
+
+	// While it backs off the primary isn't tried first.
+	before := len(primary.Sent())
+	if _, err := kea.LookupName(context.Background(), "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if sent := primary.Sent()[before:]; len(sent) != 0 {
+		t.Errorf("expected the primary to be skipped, got %v", sent)
+	}
+
+	// Once every endpoint fails the lookup fails.
+	secondary.Inject(keatest.Fault{HTTPStatus: http.StatusServiceUnavailable})
+	if _, err := kea.LookupName(context.Background(), "laptop"); err == nil {
+		t.Error("expected an error when every endpoint fails")
+	}
+	secondary.Reset()
+	if _, err := kea.LookupName(context.Background(), "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if pool.Endpoints[1].backingOff(time.Now()) {
+		t.Error("expected a successful request to clear the backoff")
+	}
+}
+
+func TestEndpointPoolPrefersHAServing(t *testing.T) {
+	standby := newLimitedControlAgent(t)
+	standby.HA = &keaclient.HAHeartbeat{State: "hot-standby", Scopes: []string{}}
+	primary := newLimitedControlAgent(t)
+	primary.HA = &keaclient.HAHeartbeat{State: "hot-standby", Scopes: []string{"server1"}}
+	pool := makeTestPool(t, true, standby, primary)
+	for _, endpoint := range pool.Endpoints {
+		endpoint.check(context.Background())
+	}
+	if pool.Endpoints[0].Serving() || !pool.Endpoints[1].Serving() {
+		t.Fatal("expected only the server with scopes to be serving")
+	}
+
+	kea := makeTestPoolKea(pool)
+	if _, err := kea.LookupName(context.Background(), "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(standby.Sent(), "lease4-get-by-hostname") {
+		t.Error("expected the standby not to be queried")
+	}
+	if !slices.Contains(primary.Sent(), "lease4-get-by-hostname") {
+		t.Error("expected the serving server to be queried")
+	}
+
+	// Without ha_heartbeat the configured order is kept.
+	pool = makeTestPool(t, false, standby, primary)
+	kea = makeTestPoolKea(pool)
+	before := len(standby.Sent())
+	if _, err := kea.LookupName(context.Background(), "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(standby.Sent()[before:], "lease4-get-by-hostname") {
+		t.Error("expected the first endpoint to be queried")
+	}
+}
+
+func TestEndpointPoolRoutesByService(t *testing.T) {
+	dhcp4 := newLimitedControlAgent(t)
+	dhcp6 := keatest.NewDirect(t, keatest.DHCP6, testFixture(t))
+	pool := makeTestPool(t, false, dhcp4, dhcp6)
+	for _, endpoint := range pool.Endpoints {
+		endpoint.check(context.Background())
+	}
+
+	kea := makeTestPoolKea(pool)
+	if _, err := kea.LookupName(context.Background(), "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(dhcp4.Sent(), "lease6-get-by-hostname") {
+		t.Error("expected lease6 lookups not to go to the dhcp4 control agent")
+	}
+	if !slices.Contains(dhcp6.Sent(), "lease6-get-by-hostname") {
+		t.Error("expected lease6 lookups to go to the dhcp6 socket")
+	}
+}
+
+func TestEndpointPoolWithoutEndpoints(t *testing.T) {
+	pool := NewEndpointPool(nil, false, nil, false)
+	if _, err := pool.Request(context.Background(), `{"command": "lease4-get-by-hostname"}`); !errors.Is(err, ErrNoEndpoints) {
+		t.Errorf("expected ErrNoEndpoints, got %v", err)
+	}
+}
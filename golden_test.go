@@ -0,0 +1,164 @@
+package kea
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ionothanus/coredns-kea/keaclient"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite resources/golden/*/records.golden")
+
+// goldenRecords decodes every response and configuration file in a
+// resources/golden directory the way the plugin does, and renders the
+// records found, one per line.
+//
+// Responses are named SERVICE.COMMAND.json, and may be in the control agent
+// format (a list) or a daemon's (a single object).
+func goldenRecords(t *testing.T, dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == "records.golden" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var records []Record
+		switch {
+		case name == "kea-dhcp4.conf":
+			var conf KeaDHCP4Conf
+			if err = json.Unmarshal(data, &conf); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			records, err = DHCP4ConfSource{Conf: conf}.List(context.Background())
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			fmt.Fprintf(&b, "%s\n", name)
+		case name == "kea-dhcp6.conf":
+			var conf KeaDHCP6Conf
+			if err = json.Unmarshal(data, &conf); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			records, err = DHCP6ConfSource{Conf: conf}.List(context.Background())
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			fmt.Fprintf(&b, "%s\n", name)
+		default:
+			service, commandName, _ := strings.Cut(strings.TrimSuffix(name, ".json"), ".")
+			command := keaclient.Command{Command: commandName, Service: []string{service}}
+			if strings.HasPrefix(commandName, "reservation-") {
+				replies, err := keaclient.Decode[keaclient.Hosts](command, data)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				for _, reply := range replies {
+					fmt.Fprintf(&b, "%s: %s %q\n", name, reply.Result, reply.Text)
+					for _, host := range slices.Concat(reply.Arguments.Hosts, reply.Arguments.Leases) {
+						records = append(records, hostRecords(host, "")...)
+					}
+				}
+			} else {
+				replies, err := keaclient.Decode[keaclient.Leases](command, data)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				for _, reply := range replies {
+					fmt.Fprintf(&b, "%s: %s %q\n", name, reply.Result, reply.Text)
+					for _, lease := range reply.Arguments.Leases {
+						records = append(records, leaseRecord(lease, ""))
+					}
+				}
+			}
+		}
+
+		for _, r := range records {
+			fmt.Fprintf(&b, "\t%s %s %s hw=%s client=%s subnet=%d cltt=%d valid=%d state=%d\n",
+				r.Kind, r.Hostname, r.IP, r.HwAddress, r.ClientID, r.SubnetID, r.Cltt, r.ValidLft, r.State)
+		}
+	}
+	return b.String()
+}
+
+// TestGolden checks that hand-written responses and configuration files, in
+// the shapes the Kea documentation describes, still decode to the same
+// records. Run with -update to accept a change.
+func TestGolden(t *testing.T) {
+	dirs, err := filepath.Glob("./resources/golden/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) == 0 {
+		t.Fatal("no golden directories found")
+	}
+
+	for _, dir := range dirs {
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			actual := goldenRecords(t, dir)
+			path := filepath.Join(dir, "records.golden")
+			if *updateGolden {
+				if err := os.WriteFile(path, []byte(actual), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			expected, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual != string(expected) {
+				t.Errorf("records differ from %s (run with -update to accept):\n%s", path, actual)
+			}
+		})
+	}
+}
+
+func FuzzDHCPConf(f *testing.F) {
+	confs, err := filepath.Glob("./resources/golden/*/kea-dhcp*.conf")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, path := range append(confs, "./resources/kea-dhcp4.conf", "./resources/kea-dhcp6.conf") {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var dhcp4Conf KeaDHCP4Conf
+		var dhcp6Conf KeaDHCP6Conf
+		var records []Record
+		if json.Unmarshal(data, &dhcp4Conf) == nil {
+			list, _ := DHCP4ConfSource{Conf: dhcp4Conf, Networks: []string{"10.0.0.0/16"}}.List(context.Background())
+			records = append(records, list...)
+		}
+		if json.Unmarshal(data, &dhcp6Conf) == nil {
+			list, _ := DHCP6ConfSource{Conf: dhcp6Conf}.List(context.Background())
+			records = append(records, list...)
+		}
+		for _, record := range records {
+			if record.IP == nil {
+				t.Errorf("record for %q has no address", record.Hostname)
+			}
+		}
+	})
+}
@@ -0,0 +1,189 @@
+package kea
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Defaults for the limits on lookup requests to each Kea server.
+const defaultMaxConcurrentRequests = 32
+const defaultBreakerFailures = 5
+const defaultBreakerCooldown = 30 * time.Second
+
+var (
+	// ErrRateLimited is returned when a request exceeds request_rate, or
+	// can't start before its deadline because of max_concurrent_requests.
+	ErrRateLimited = errors.New("Kea request rejected by rate limit")
+	// ErrCircuitOpen is returned while the circuit breaker is open.
+	ErrCircuitOpen = errors.New("Kea circuit breaker is open")
+)
+
+// RequestLimits configures a RequestGuard. Zero values disable a limit.
+type RequestLimits struct {
+	// MaxConcurrent is the number of requests in flight at once.
+	MaxConcurrent int
+	// Rate is the number of requests started per second, with bursts of
+	// up to Burst requests.
+	Rate  float64
+	Burst int
+	// BreakerFailures is the number of consecutive failed requests which
+	// open the circuit breaker, and BreakerCooldown how long it stays open
+	// before a request is let through to try again.
+	BreakerFailures int
+	BreakerCooldown time.Duration
+}
+
+// DefaultRequestLimits returns the limits used unless configured otherwise.
+func DefaultRequestLimits() RequestLimits {
+	return RequestLimits{
+		MaxConcurrent:   defaultMaxConcurrentRequests,
+		BreakerFailures: defaultBreakerFailures,
+		BreakerCooldown: defaultBreakerCooldown,
+	}
+}
+
+// RequestGuard protects a Kea server from query storms: it limits the
+// requests in flight and their rate, and stops sending requests for a
+// while after several fail in a row.
+type RequestGuard struct {
+	Limits RequestLimits
+	// Backend labels the guard's metrics and logs.
+	Backend string
+
+	slots chan struct{}
+
+	mu       sync.Mutex
+	tokens   float64
+	refilled time.Time
+	failures int
+	openedAt time.Time
+	open     bool
+	probing  bool
+}
+
+type backgroundRequestKey struct{}
+
+// withBackground marks the requests made with ctx as background work, the
+// statistics and the inventory, rather than lookups for queries. The guard
+// doesn't apply to them: they take no slot or token, and their failures
+// don't count toward the circuit breaker, so they can't starve or trip the
+// lookups it protects.
+func withBackground(ctx context.Context) context.Context {
+	return context.WithValue(ctx, backgroundRequestKey{}, true)
+}
+
+func isBackground(ctx context.Context) bool {
+	background, _ := ctx.Value(backgroundRequestKey{}).(bool)
+	return background
+}
+
+func NewRequestGuard(limits RequestLimits, backend string) *RequestGuard {
+	guard := &RequestGuard{Limits: limits, Backend: backend, tokens: float64(limits.Burst)}
+	if limits.MaxConcurrent > 0 {
+		guard.slots = make(chan struct{}, limits.MaxConcurrent)
+	}
+	if guard.tokens < 1 {
+		guard.tokens = 1
+	}
+	return guard
+}
+
+// Acquire checks the circuit breaker and rate limit, then waits for a
+// request slot until ctx is done. When it succeeds, the caller must call
+// Done with the request's outcome.
+func (g *RequestGuard) Acquire(ctx context.Context) error {
+	now := time.Now()
+
+	g.mu.Lock()
+	if g.open {
+		if g.probing || now.Sub(g.openedAt) < g.Limits.BreakerCooldown {
+			g.mu.Unlock()
+			requestsShortCircuited.WithLabelValues(g.Backend).Inc()
+			return ErrCircuitOpen
+		}
+		// Let one request through to find out whether Kea has recovered.
+		g.probing = true
+	}
+	if g.Limits.Rate > 0 && !g.take(now) {
+		g.probing = false
+		g.mu.Unlock()
+		requestsRejected.WithLabelValues(g.Backend, "rate").Inc()
+		return ErrRateLimited
+	}
+	g.mu.Unlock()
+
+	if g.slots == nil {
+		return nil
+	}
+	select {
+	case g.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		g.mu.Lock()
+		g.probing = false
+		g.mu.Unlock()
+		requestsRejected.WithLabelValues(g.Backend, "concurrency").Inc()
+		return ErrRateLimited
+	}
+}
+
+// take removes a token from the bucket, refilling it for the time passed.
+func (g *RequestGuard) take(now time.Time) bool {
+	burst := max(float64(g.Limits.Burst), 1)
+	if !g.refilled.IsZero() {
+		g.tokens = min(burst, g.tokens+now.Sub(g.refilled).Seconds()*g.Limits.Rate)
+	}
+	g.refilled = now
+	if g.tokens < 1 {
+		return false
+	}
+	g.tokens--
+	return true
+}
+
+// Done releases a request's slot and records whether it failed, opening or
+// closing the circuit breaker. Requests cut short by their own deadline
+// don't count as failures.
+func (g *RequestGuard) Done(ctx context.Context, err error) {
+	if g.slots != nil {
+		<-g.slots
+	}
+	if err != nil && ctx.Err() != nil {
+		g.mu.Lock()
+		g.probing = false
+		g.mu.Unlock()
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.probing = false
+	if err == nil {
+		if g.open {
+			log.Infof("Kea circuit breaker%s closed", g.label())
+			circuitOpen.WithLabelValues(g.Backend).Set(0)
+		}
+		g.open = false
+		g.failures = 0
+		return
+	}
+
+	g.failures++
+	if g.Limits.BreakerFailures > 0 && g.failures >= g.Limits.BreakerFailures {
+		if !g.open {
+			log.Warningf("Kea circuit breaker%s opened after %d failed requests: %v", g.label(), g.failures, err)
+			circuitOpen.WithLabelValues(g.Backend).Set(1)
+		}
+		g.open = true
+		g.openedAt = time.Now()
+	}
+}
+
+func (g *RequestGuard) label() string {
+	if g.Backend == "" {
+		return ""
+	}
+	return " for " + g.Backend
+}
@@ -0,0 +1,112 @@
+package kea
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ionothanus/coredns-kea/keatest"
+)
+
+func TestRequestGuardRate(t *testing.T) {
+	guard := NewRequestGuard(RequestLimits{Rate: 1, Burst: 2}, "")
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := guard.Acquire(ctx); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		guard.Done(ctx, nil)
+	}
+	if err := guard.Acquire(ctx); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("expected the burst to be exhausted, got %v", err)
+	}
+}
+
+func TestRequestGuardConcurrency(t *testing.T) {
+	guard := NewRequestGuard(RequestLimits{MaxConcurrent: 1}, "")
+	if err := guard.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := guard.Acquire(ctx); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("expected a second request to wait and give up, got %v", err)
+	}
+
+	guard.Done(context.Background(), nil)
+	if err := guard.Acquire(context.Background()); err != nil {
+		t.Errorf("expected the slot to be free again, got %v", err)
+	}
+}
+
+func TestRequestGuardBreaker(t *testing.T) {
+	guard := NewRequestGuard(RequestLimits{BreakerFailures: 2, BreakerCooldown: 50 * time.Millisecond}, "")
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := guard.Acquire(ctx); err != nil {
+			t.Fatal(err)
+		}
+		guard.Done(ctx, errors.New("connection refused"))
+	}
+	if err := guard.Acquire(ctx); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the breaker to open, got %v", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := guard.Acquire(ctx); err != nil {
+		t.Fatalf("expected a probe after the cooldown, got %v", err)
+	}
+	if err := guard.Acquire(ctx); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected only one probe at a time, got %v", err)
+	}
+	guard.Done(ctx, nil)
+	if err := guard.Acquire(ctx); err != nil {
+		t.Errorf("expected a successful probe to close the breaker, got %v", err)
+	}
+}
+
+func TestEndpointPoolBackgroundRequests(t *testing.T) {
+	server := newLimitedControlAgent(t)
+	server.Inject(keatest.Fault{HTTPStatus: http.StatusServiceUnavailable})
+	pool := makeTestPool(t, false, server)
+	pool.Guard = NewRequestGuard(RequestLimits{Rate: 1, Burst: 1, BreakerFailures: 1, BreakerCooldown: time.Minute}, "")
+
+	// Failed background requests neither use up the token nor open the
+	// breaker.
+	collector := NewStatisticsCollector("", pool, []string{"dhcp4"}, time.Minute)
+	for i := 0; i < 2; i++ {
+		if err := collector.Collect(withBackground(context.Background())); err == nil {
+			t.Fatal("expected the statistics request to fail")
+		}
+	}
+	if err := pool.Guard.Acquire(context.Background()); err != nil {
+		t.Errorf("expected lookups to be let through, got %v", err)
+	}
+}
+
+func TestEndpointPoolShortCircuits(t *testing.T) {
+	server := newLimitedControlAgent(t)
+	server.Inject(keatest.Fault{HTTPStatus: http.StatusServiceUnavailable})
+	pool := makeTestPool(t, false, server)
+	pool.Guard = NewRequestGuard(RequestLimits{BreakerFailures: 2, BreakerCooldown: time.Minute}, "")
+
+	kea := makeTestPoolKea(pool)
+	kea.UseIPv6 = "false"
+	for i := 0; i < 2; i++ {
+		if _, err := kea.LookupName(context.Background(), "laptop"); err == nil {
+			t.Fatal("expected the lookup to fail")
+		}
+	}
+
+	before := len(server.Sent())
+	_, err := kea.LookupName(context.Background(), "laptop")
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected the circuit breaker to answer, got %v", err)
+	}
+	if sent := server.Sent()[before:]; len(sent) != 0 {
+		t.Errorf("expected no requests while the breaker is open, got %v", sent)
+	}
+}
@@ -0,0 +1,49 @@
+package kea
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// IdentifierNameTypes maps the types used by the identifier_names directive
+// to the identifiers they look up.
+var IdentifierNameTypes = map[string]string{
+	"mac":       IdentifierHwAddress,
+	"client_id": IdentifierClientID,
+	"duid":      IdentifierDUID,
+}
+
+// IdentifierName is a zone whose names are client identifiers, such as
+// 00-11-22-33-44-55.mac.lan for the hardware address 00:11:22:33:44:55.
+type IdentifierName struct {
+	// Type is IdentifierHwAddress, IdentifierClientID or IdentifierDUID.
+	Type string
+	Zone string
+}
+
+// match returns the identifier a name in the zone stands for. The name has a
+// single label in front of the zone, made of the identifier's hex bytes,
+// which may be separated by dashes.
+func (n IdentifierName) match(qname string) (identifier string, ok bool) {
+	label, ok := strings.CutSuffix(dns.CanonicalName(qname), "."+dns.CanonicalName(n.Zone))
+	if !ok || label == "" || strings.Contains(label, ".") {
+		return "", false
+	}
+	digits := normalizeIdentifier(label)
+	if _, err := hex.DecodeString(digits); err != nil || digits == "" {
+		return "", false
+	}
+	return splitHex(digits, ":"), true
+}
+
+// matchIdentifierName finds the identifier zone a query name is in, if any.
+func (k Kea) matchIdentifierName(qname string) (identifierType string, identifier string, ok bool) {
+	for _, name := range k.IdentifierNames {
+		if identifier, ok := name.match(qname); ok {
+			return name.Type, identifier, true
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,103 @@
+package kea
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestServeIdentifierNames(t *testing.T) {
+	identifierNames := []IdentifierName{
+		{Type: IdentifierHwAddress, Zone: "mac.lan"},
+		{Type: IdentifierClientID, Zone: "client-id.lan."},
+		{Type: IdentifierDUID, Zone: "duid.lan"},
+	}
+
+	kea, _ := MakeTestKeaControlAgent(t)
+	kea.ExtractHostname = "true"
+	kea.IdentifierNames = identifierNames
+	kea.Next = fallthroughHandler()
+
+	conf := MakeTestKeaConfFiles()
+	conf.IdentifierNames = identifierNames
+	conf.Next = fallthroughHandler()
+
+	tests := []struct {
+		kea Kea
+		test.Case
+	}{
+		{kea, test.Case{
+			Qname: "00-11-22-33-44-66.mac.lan.", Qtype: dns.TypeA, Authoritative: true,
+			Answer: []dns.RR{test.A("00-11-22-33-44-66.mac.lan. 60 IN A 10.0.0.20")},
+		}},
+		{kea, test.Case{
+			Qname: "001122334466.MAC.lan.", Qtype: dns.TypeA, Authoritative: true,
+			Answer: []dns.RR{test.A("001122334466.MAC.lan. 60 IN A 10.0.0.20")},
+		}},
+		{kea, test.Case{
+			Qname: "01-00-11-22-33-44-66.client-id.lan.", Qtype: dns.TypeA, Authoritative: true,
+			Answer: []dns.RR{test.A("01-00-11-22-33-44-66.client-id.lan. 60 IN A 10.0.0.20")},
+		}},
+		{kea, test.Case{
+			Qname: "00-03-00-01-00-11-22-33-44-66.duid.lan.", Qtype: dns.TypeAAAA, Authoritative: true,
+			Answer: []dns.RR{test.AAAA("00-03-00-01-00-11-22-33-44-66.duid.lan. 60 IN AAAA 2001:db8:1::20")},
+		}},
+		// Kea can't look DHCPv6 leases up by hardware address.
+		{kea, test.Case{Qname: "00-11-22-33-44-66.mac.lan.", Qtype: dns.TypeAAAA, Rcode: dns.RcodeNameError}},
+		{kea, test.Case{Qname: "00-11-22-33-44-99.mac.lan.", Qtype: dns.TypeA, Rcode: dns.RcodeNameError}},
+		// Reservations in conf files are found by their identifiers.
+		{conf, test.Case{
+			Qname: "00-11-22-33-44-55.mac.lan.", Qtype: dns.TypeA, Authoritative: true,
+			Answer: []dns.RR{test.A("00-11-22-33-44-55.mac.lan. 60 IN A 10.0.0.150")},
+		}},
+		{conf, test.Case{
+			Qname: "00-11-22-33-44-55.mac.lan.", Qtype: dns.TypeAAAA, Authoritative: true,
+			Answer: []dns.RR{test.AAAA("00-11-22-33-44-55.mac.lan. 60 IN AAAA 2001:db8:1::1234")},
+		}},
+	}
+
+	for i, tc := range tests {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, err := tc.kea.ServeDNS(context.Background(), rec, tc.Msg())
+		if err != nil {
+			t.Errorf("Test %d: unexpected error %v", i, err)
+			continue
+		}
+		if rcode != tc.Rcode {
+			t.Errorf("Test %d: expected rcode %s, got %s", i, dns.RcodeToString[tc.Rcode], dns.RcodeToString[rcode])
+		}
+		if rec.Msg == nil {
+			t.Errorf("Test %d: no response written", i)
+			continue
+		}
+		if err := test.SortAndCheck(rec.Msg, tc.Case); err != nil {
+			t.Errorf("Test %d: %v", i, err)
+		}
+	}
+}
+
+func TestIdentifierNameMatch(t *testing.T) {
+	name := IdentifierName{Type: IdentifierHwAddress, Zone: "mac.lan"}
+	tests := []struct {
+		qname    string
+		expected string
+	}{
+		{"00-11-22-33-44-55.mac.lan.", "00:11:22:33:44:55"},
+		{"00112233AABB.mac.lan.", "00:11:22:33:aa:bb"},
+		{"mac.lan.", ""},
+		{"laptop.mac.lan.", ""},
+		{"0-11-22-33-44-55.mac.lan.", ""},
+		{"00-11.22-33-44-55.mac.lan.", ""},
+		{"00-11-22-33-44-55.example.lan.", ""},
+	}
+	for _, tc := range tests {
+		identifier, _ := name.match(tc.qname)
+		if identifier != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.qname, tc.expected, identifier)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package kea
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+)
+
+// How often the inventory gauges are recomputed, and how long listing the
+// sources may take.
+const inventoryInterval = time.Minute
+const inventoryTimeout = 30 * time.Second
+
+// Inventory summarises what the plugin publishes from the sources which can
+// list every record they hold: configuration files, lease files, and Kea's
+// control API with lease4-get-all, lease6-get-all and reservation-get-all.
+// The lease database is only queried by name, so its records aren't
+// included.
+type Inventory struct {
+	// Hostnames counts the distinct hostnames with a published address.
+	Hostnames int
+	// Addresses counts distinct published addresses by family, 4 or 6.
+	Addresses map[int]int
+	// Records counts published records by kind.
+	Records map[string]int
+	// FilteredHostnames counts hostnames with addresses, all of which are
+	// outside networks.
+	FilteredHostnames int
+	// ConflictingHostnames counts published hostnames with addresses of
+	// one family held by more than one client.
+	ConflictingHostnames int
+}
+
+// Inventory lists every Lister source and works out what a query for each
+// hostname would be answered with. Sources which fail are logged and skipped.
+func (k Kea) Inventory(ctx context.Context) (inventory Inventory, err error) {
+	// As in LookupName, the first source to return an address for a
+	// hostname wins.
+	byHostname := map[string][]Record{}
+	// Hostnames with no published address: those of records a source's own
+	// filter dropped, and those whose addresses are all outside networks.
+	filtered := map[string]bool{}
+	for _, source := range k.sources() {
+		lister, ok := source.(Lister)
+		if !ok {
+			continue
+		}
+		records, err := lister.List(ctx)
+		if err != nil {
+			log.Warningf("Listing %s for the inventory failed: %v", sourceLabel(source), err)
+			continue
+		}
+		for _, record := range records {
+			if record.Hostname == "" || record.IP == nil {
+				continue
+			}
+			hostname := inventoryHostname(record)
+			if !containsIP(byHostname[hostname], record) {
+				byHostname[hostname] = append(byHostname[hostname], record)
+			}
+		}
+
+		dropped, err := droppedBySource(ctx, source, records)
+		if err != nil {
+			log.Warningf("Listing %s for the inventory failed: %v", sourceLabel(source), err)
+			continue
+		}
+		for _, record := range dropped {
+			if record.Hostname != "" {
+				filtered[inventoryHostname(record)] = true
+			}
+		}
+	}
+
+	inventory.Addresses = map[int]int{4: 0, 6: 0}
+	inventory.Records = map[string]int{RecordKindLease: 0, RecordKindReservation: 0, RecordKindConf: 0}
+	addresses := map[string]bool{}
+	for hostname, records := range byHostname {
+		published, err := k.FilterRecords(records)
+		if err != nil {
+			return Inventory{}, err
+		}
+		if len(published) == 0 {
+			filtered[hostname] = true
+			continue
+		}
+		delete(filtered, hostname)
+		inventory.Hostnames++
+		published = MergeBackends(published)
+		if hasConflict(published) {
+			inventory.ConflictingHostnames++
+		}
+		published = k.ResolveConflicts(published)
+		for _, record := range published {
+			inventory.Records[record.Kind]++
+			if !addresses[record.IP.String()] {
+				addresses[record.IP.String()] = true
+				inventory.Addresses[recordFamily(record)]++
+			}
+		}
+	}
+	inventory.FilteredHostnames = len(filtered)
+	return inventory, nil
+}
+
+func inventoryHostname(record Record) string {
+	return strings.ToLower(strings.TrimSuffix(record.Hostname, "."))
+}
+
+// droppedBySource returns the records a conf file source leaves out of
+// listed, as their subnet isn't one of its networks. Lookups apply the same
+// filter, so these hostnames are only counted as filtered.
+func droppedBySource(ctx context.Context, source Source, listed []Record) (dropped []Record, err error) {
+	var all []Record
+	switch s := source.(type) {
+	case DHCP4ConfSource:
+		if len(s.Networks) == 0 {
+			return nil, nil
+		}
+		s.Networks = nil
+		all, err = s.List(ctx)
+	case DHCP6ConfSource:
+		if len(s.Networks) == 0 {
+			return nil, nil
+		}
+		s.Networks = nil
+		all, err = s.List(ctx)
+	default:
+		return nil, nil
+	}
+	return slices.DeleteFunc(all, func(r Record) bool { return containsIP(listed, r) }), err
+}
+
+func containsIP(records []Record, record Record) bool {
+	for _, r := range records {
+		if r.IP.Equal(record.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func recordFamily(record Record) int {
+	if record.IP.To4() != nil {
+		return 4
+	}
+	return 6
+}
+
+// recordClient names the client holding a record by its hardware address,
+// or its client-id or DUID. It is empty when neither is known. A client may
+// be named differently in its other records; see sameClient.
+func recordClient(record Record) string {
+	if record.HwAddress != "" {
+		return strings.ToLower(record.HwAddress)
+	}
+	return strings.ToLower(record.ClientID)
+}
+
+// hasConflict reports whether a hostname's records of one family belong to
+// more than one client. Records without a known client are ignored.
+func hasConflict(records []Record) bool {
+	groups := clientGroups(records)
+	clients := map[int]int{}
+	for i, record := range records {
+		if groups[i] == -1 {
+			continue
+		}
+		family := recordFamily(record)
+		if previous, ok := clients[family]; ok && previous != groups[i] {
+			return true
+		}
+		clients[family] = groups[i]
+	}
+	return false
+}
+
+// export sets the inventory gauges of a server.
+func (inventory Inventory) export(server string) {
+	inventoryHostnames.WithLabelValues(server).Set(float64(inventory.Hostnames))
+	for family, count := range inventory.Addresses {
+		inventoryAddresses.WithLabelValues(server, familyLabel(family)).Set(float64(count))
+	}
+	for kind, count := range inventory.Records {
+		inventoryRecords.WithLabelValues(server, kind).Set(float64(count))
+	}
+	inventoryFilteredHostnames.WithLabelValues(server).Set(float64(inventory.FilteredHostnames))
+	inventoryConflictingHostnames.WithLabelValues(server).Set(float64(inventory.ConflictingHostnames))
+}
+
+func familyLabel(family int) string {
+	if family == 4 {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// hasListers reports whether any source can be listed for the inventory.
+func (k Kea) hasListers() bool {
+	for _, source := range k.sources() {
+		if _, ok := source.(Lister); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// InventoryExporter periodically recomputes the inventory gauges.
+type InventoryExporter struct {
+	Kea Kea
+	// Server labels the gauges, as the metrics plugin labels queries to the
+	// server block the plugin is in.
+	Server   string
+	Interval time.Duration
+	// Timeout bounds each recomputation.
+	Timeout time.Duration
+
+	loop loop
+}
+
+// Start exports the inventory now, and then every Interval.
+func (e *InventoryExporter) Start() {
+	e.loop.start(e.Interval, e.Timeout, true, func(ctx context.Context) {
+		inventory, err := e.Kea.Inventory(withBackground(ctx))
+		if err != nil {
+			log.Warningf("Failed to compute the inventory: %v", err)
+			return
+		}
+		inventory.export(e.Server)
+	})
+}
+
+// Stop ends the exports started by Start.
+func (e *InventoryExporter) Stop() {
+	e.loop.stop()
+}
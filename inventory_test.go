@@ -0,0 +1,135 @@
+package kea
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ionothanus/coredns-kea/keatest"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInventory(t *testing.T) {
+	withClient := func(record Record, hwAddress string) Record {
+		record.HwAddress = hwAddress
+		return record
+	}
+	reservation := testRecord(SourceDHCP4Conf, "nas", "10.0.0.160")
+	reservation.Kind = RecordKindConf
+
+	kea := Kea{
+		Networks: []string{"10.0.0.0/16", "2001:db8::/32"},
+		Sources: []Source{
+			testSource{name: SourceLease4File, records: []Record{
+				withClient(testRecord(SourceLease4File, "laptop", "10.0.0.20"), "aa:bb:cc:dd:ee:01"),
+				// Two clients claim "phone".
+				withClient(testRecord(SourceLease4File, "phone", "10.0.0.30"), "aa:bb:cc:dd:ee:02"),
+				withClient(testRecord(SourceLease4File, "Phone.", "10.0.0.31"), "aa:bb:cc:dd:ee:03"),
+				// Outside networks.
+				testRecord(SourceLease4File, "guest", "192.168.1.10"),
+				// Not published without a hostname.
+				testRecord(SourceLease4File, "", "10.0.0.40"),
+			}},
+			testSource{name: SourceLease6File, records: []Record{
+				withClient(testRecord(SourceLease6File, "laptop", "2001:db8:1::20"), "aa:bb:cc:dd:ee:01"),
+				// Already returned by the lease file.
+				testRecord(SourceLease6File, "laptop", "10.0.0.20"),
+			}},
+			testSource{name: SourceDHCP4Conf, records: []Record{reservation}},
+			testSource{name: SourceLeaseDB, err: errors.New("unavailable")},
+			// Sources which can't be listed aren't included.
+			LeaseDBSource{},
+		},
+	}
+
+	inventory, err := kea.Inventory(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Inventory{
+		Hostnames:            3,
+		Addresses:            map[int]int{4: 4, 6: 1},
+		Records:              map[string]int{RecordKindLease: 4, RecordKindReservation: 0, RecordKindConf: 1},
+		FilteredHostnames:    1,
+		ConflictingHostnames: 1,
+	}
+	if !reflect.DeepEqual(inventory, expected) {
+		t.Errorf("expected %+v, got %+v", expected, inventory)
+	}
+
+	inventory.export("dns://:53")
+	Inventory{}.export("dns://:5353")
+	if hostnames := testutil.ToFloat64(inventoryHostnames.WithLabelValues("dns://:53")); hostnames != 3 {
+		t.Errorf("expected 3 hostnames, got %v", hostnames)
+	}
+	if addresses := testutil.ToFloat64(inventoryAddresses.WithLabelValues("dns://:53", "ipv6")); addresses != 1 {
+		t.Errorf("expected 1 IPv6 address, got %v", addresses)
+	}
+}
+
+func TestInventoryMatchesLookup(t *testing.T) {
+	// The subnet of host1's IPv4 reservation is inside networks, but isn't
+	// one of them, so lookups don't publish it.
+	kea := MakeTestKeaConfFiles()
+	kea.Networks = []string{"10.0.0.0/8"}
+
+	inventory, err := kea.Inventory(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inventory.Hostnames != 0 || inventory.FilteredHostnames != 1 || inventory.Records[RecordKindConf] != 0 {
+		t.Errorf("expected host1 to be filtered, got %+v", inventory)
+	}
+	if ips := hostnameIPs(t, kea, "host1"); ips != "" {
+		t.Errorf("expected no lookup results, got %q", ips)
+	}
+}
+
+func TestInventoryControlAgent(t *testing.T) {
+	kea, server := MakeTestKeaControlAgent(t)
+
+	inventory, err := kea.Inventory(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Inventory{
+		Hostnames:         3,
+		Addresses:         map[int]int{4: 3, 6: 2},
+		Records:           map[string]int{RecordKindLease: 3, RecordKindReservation: 2, RecordKindConf: 0},
+		FilteredHostnames: 0,
+	}
+	if !reflect.DeepEqual(inventory, expected) {
+		t.Errorf("expected %+v, got %+v", expected, inventory)
+	}
+	for _, command := range []string{"lease4-get-all", "lease6-get-all", "config-get", "reservation-get-all"} {
+		if !slices.Contains(server.Sent(), command) {
+			t.Errorf("expected %s to be sent", command)
+		}
+	}
+}
+
+func TestInventoryExporterStopsWhenKeaHangs(t *testing.T) {
+	kea, server := MakeTestKeaControlAgent(t)
+	server.Inject(keatest.Fault{Command: "lease4-get-all", Latency: time.Hour})
+
+	exporter := &InventoryExporter{Kea: kea, Server: "dns://:53", Interval: time.Hour, Timeout: 100 * time.Millisecond}
+	exporter.Start()
+	for !slices.Contains(server.Sent(), "lease4-get-all") {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		exporter.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop didn't return while Kea hung")
+	}
+}
@@ -1,19 +1,17 @@
 package kea
 
 import (
-	"bytes"
 	"context"
-	"crypto/tls"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"net"
-	"net/http"
 	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
 	"github.com/coredns/coredns/request"
 
@@ -25,27 +23,8 @@ var log = clog.NewWithPlugin("kea")
 const KEA_IPV4_SERVICE_NAME = "dhcp4"
 const KEA_IPV6_SERVICE_NAME = "dhcp6"
 
-const KEA_LIST_LEASES_BY_HOSTNAME_TEMPLATE = `{
-  "command": "lease4-get-by-hostname",
-  "arguments": {
-    "hostname": "%s"
-  },
-  "service": [
-    %s
-  ]
-}`
-const KEA_LIST_RESERVATIONS_BY_HOSTNAME_TEMPLATE = `{
-  "command": "reservation-get-by-hostname",
-  "arguments": {
-    "hostname": "%s"
-  },
-  "service": [
-    %s
-  ]
-}`
-
 type Kea struct {
-	ControlAgent             string
+	ControlAgents            []string
 	Networks                 []string
 	ExtractHostname          string
 	ControlAgentLeases       string
@@ -58,22 +37,63 @@ type Kea struct {
 	DHCP6ConfPath            string
 	DHCP4Conf                KeaDHCP4Conf
 	DHCP6Conf                KeaDHCP6Conf
+	Lease4FilePath           string
+	Lease6FilePath           string
+	Lease4File               *LeaseFile
+	Lease6File               *LeaseFile
+	LeaseDB                  *LeaseDB
+	Sources                  []Source
+	LookupTimeout            time.Duration
+	Endpoints                *EndpointPool
+	Backends                 []Backend
+	TXTClients               []string
+	SyntheticNames           []SyntheticName
+	IdentifierNames          []IdentifierName
+	WhoAmI                   string
+	CorrelateFamilies        string
+	ConflictPolicy           string
+	Conflicts                *ConflictLog
 }
 
-func (k Kea) httpClient() *http.Client {
-	if k.Insecure == "true" {
-		transCfg := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-		return &http.Client{Transport: transCfg}
+// services returns the Kea services for the enabled address families.
+func (k Kea) services() (services []string) {
+	if k.UseIPv4 == "true" {
+		services = append(services, KEA_IPV4_SERVICE_NAME)
+	}
+	if k.UseIPv6 == "true" {
+		services = append(services, KEA_IPV6_SERVICE_NAME)
+	}
+	return
+}
+
+func (k Kea) controlAgentClient() ControlAgentClient {
+	endpoints := k.Endpoints
+	if endpoints == nil {
+		endpoints = NewEndpointPool(k.ControlAgents, k.Insecure == "true", k.services(), false)
+	}
+	return ControlAgentClient{
+		Endpoints: endpoints,
+		UseIPv4:   k.UseIPv4 == "true",
+		UseIPv6:   k.UseIPv6 == "true",
 	}
-	return &http.Client{}
 }
 
 func (k Kea) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	state := request.Request{W: w, Req: r}
+	server := metrics.WithServer(ctx)
+	requestCount.WithLabelValues(server).Inc()
+
+	if k.WhoAmI != "" && state.Name() == dns.CanonicalName(k.WhoAmI) {
+		return k.serveWhoAmI(ctx, w, r, state, server)
+	}
 
-	if state.QType() != dns.TypeA && state.QType() != dns.TypeAAAA {
+	if state.QType() == dns.TypePTR && len(k.SyntheticNames) > 0 {
+		return k.servePTR(ctx, w, r, state, server)
+	}
+
+	txt := state.QType() == dns.TypeTXT && k.TXTAllowed(state.IP())
+	if state.QType() != dns.TypeA && state.QType() != dns.TypeAAAA && !txt {
+		queryOutcomes.WithLabelValues(server, state.Type(), OutcomeFallthrough).Inc()
 		return plugin.NextOrFailure(k.Name(), k.Next, ctx, w, r)
 	}
 
@@ -88,16 +108,30 @@ func (k Kea) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (in
 		nameLookup = strings.SplitN(nameLookup, ".", 2)[0]
 	}
 
-	ips, err := k.GetIPsForHostname(nameLookup)
+	var records []Record
+	var err error
+	if identifierType, identifier, ok := k.matchIdentifierName(state.QName()); ok {
+		records, err = k.LookupIdentifier(ctx, identifierType, identifier)
+	} else {
+		records, err = k.LookupNameFor(ctx, nameLookup, state.QType())
+		if err == nil && len(records) == 0 && len(k.SyntheticNames) > 0 {
+			records, err = k.LookupSynthetic(ctx, state.QName())
+		}
+	}
 
 	if err != nil {
+		queryOutcomes.WithLabelValues(server, state.Type(), OutcomeError).Inc()
 		return plugin.NextOrFailure(k.Name(), k.Next, ctx, w, r)
 	}
 
 	found := false
 
-	for _, ip := range ips {
+	for _, record := range records {
+		ip := record.IP
 		if ip.To4() == nil && state.QType() == dns.TypeAAAA {
+			if !found {
+				setAnswered(ctx, record)
+			}
 			found = true
 			m.Answer = append(m.Answer, &dns.AAAA{
 				Hdr: dns.RR_Header{
@@ -109,6 +143,9 @@ func (k Kea) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (in
 				AAAA: ip,
 			})
 		} else if ip.To4() != nil && state.QType() == dns.TypeA {
+			if !found {
+				setAnswered(ctx, record)
+			}
 			found = true
 			m.Answer = append(m.Answer, &dns.A{
 				Hdr: dns.RR_Header{
@@ -119,211 +156,246 @@ func (k Kea) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (in
 				},
 				A: ip,
 			})
+		} else if txt {
+			if !found {
+				setAnswered(ctx, record)
+			}
+			found = true
+			m.Answer = append(m.Answer, recordTXT(state.QName(), record))
 		}
 	}
 
 	if !found {
+		outcome := OutcomeFallthrough
+		if len(records) > 0 {
+			outcome = OutcomeNoData
+		}
+		queryOutcomes.WithLabelValues(server, state.Type(), outcome).Inc()
 		return plugin.NextOrFailure(k.Name(), k.Next, ctx, w, r)
 	}
+	queryOutcomes.WithLabelValues(server, state.Type(), OutcomeAnswered).Inc()
 	err = w.WriteMsg(m)
 	return 0, err
 }
 
 func (k Kea) Name() string { return "kea" }
 
-func (k Kea) serviceNames() string {
-	services := []string{}
-	if k.UseIPv4 == "true" {
-		services = append(services, fmt.Sprintf(`"%s"`, KEA_IPV4_SERVICE_NAME))
-	}
-	if k.UseIPv6 == "true" {
-		services = append(services, fmt.Sprintf(`"%s"`, KEA_IPV6_SERVICE_NAME))
-	}
-	return strings.Join(services, ", ")
+func (k Kea) MakeControlAgentRequest(requestBody string) (responseBody []byte, err error) {
+	return k.controlAgentClient().Request(context.Background(), requestBody)
 }
 
-func (k Kea) MakeControlAgentRequest(requestBody string) (responseBody []byte, err error) {
-	requestBodyBytes := bytes.NewBufferString(requestBody)
+func (k Kea) ControlAgentGetIPsForLease(deviceName string) (ips []net.IP, err error) {
+	return k.getIPsFromSource(ControlAgentLeaseSource{Client: k.controlAgentClient()}, deviceName)
+}
 
-	resp, err := k.httpClient().Post(k.ControlAgent, "application/json", requestBodyBytes)
+func (k Kea) ControlAgentGetIPsForReservation(deviceName string) (ips []net.IP, err error) {
+	return k.getIPsFromSource(ControlAgentReservationSource{Client: k.controlAgentClient()}, deviceName)
+}
 
+func (k Kea) getIPsFromSource(source Source, deviceName string) (ips []net.IP, err error) {
+	records, err := source.LookupName(context.Background(), deviceName)
 	if err != nil {
-		return
-	}
-	if resp.StatusCode != 200 {
-		err = errors.New(resp.Status)
-		return
+		return nil, err
 	}
-	body, err := io.ReadAll(resp.Body)
+	records, err = k.FilterRecords(records)
 	if err != nil {
-		return
+		return nil, err
 	}
-
-	return body, nil
+	return RecordIPs(k.ResolveConflicts(records)), nil
 }
 
-func (k Kea) ControlAgentGetIPsForLease(deviceName string) (ips []net.IP, err error) {
-	responseBody, err := k.MakeControlAgentRequest(
-		fmt.Sprintf(KEA_LIST_LEASES_BY_HOSTNAME_TEMPLATE,
-			deviceName,
-			k.serviceNames()))
+func CompareCIDRs(subnet1 string, subnet2 string) bool {
+	_, net1, err := net.ParseCIDR(subnet1)
 	if err != nil {
-		return
+		return false
 	}
-
-	var leaseRecords KeaLeaseRecords
-	err = json.Unmarshal(responseBody, &leaseRecords)
+	_, net2, err := net.ParseCIDR(subnet2)
 	if err != nil {
-		return
+		return false
 	}
+	return net1.String() == net2.String()
+}
 
-	ipResult := new([]net.IP)
-
-	for _, leaseRecord := range leaseRecords {
-		switch leaseRecord.Result {
-		case Success:
-			for _, lease := range leaseRecord.Arguments.Leases {
-				ip := net.ParseIP(lease.IPAddress)
-				if !ip.IsLoopback() {
-					*ipResult = append(*ipResult, ip)
-				}
-			}
-		case Error:
-			log.Warning("Kea error: " + leaseRecord.Text)
+// ConfiguredSources returns a Source for each lookup method enabled in the
+// configuration, in the default order.
+func (k Kea) ConfiguredSources() (sources []Source) {
+	clients := k.controlAgentClients()
+	if k.ControlAgentLeases == "true" {
+		for _, client := range clients {
+			sources = append(sources, ControlAgentLeaseSource{Client: client})
 		}
 	}
-
-	if len(k.Networks) > 0 {
-		ips, err = FilterIPsInCIDRs(*ipResult, k.Networks)
-		if err != nil {
-			return nil, err
+	if k.ControlAgentReservations == "true" {
+		for _, client := range clients {
+			sources = append(sources, ControlAgentReservationSource{Client: client})
 		}
-	} else {
-		ips = *ipResult
 	}
-
+	if k.DHCP4ConfPath != "" {
+		sources = append(sources, DHCP4ConfSource{Conf: k.DHCP4Conf, Networks: k.Networks})
+	}
+	if k.DHCP6ConfPath != "" {
+		sources = append(sources, DHCP6ConfSource{Conf: k.DHCP6Conf, Networks: k.Networks})
+	}
+	if k.Lease4File != nil {
+		sources = append(sources, LeaseFileSource{SourceName: SourceLease4File, File: k.Lease4File})
+	}
+	if k.Lease6File != nil {
+		sources = append(sources, LeaseFileSource{SourceName: SourceLease6File, File: k.Lease6File})
+	}
+	if k.LeaseDB != nil {
+		sources = append(sources, LeaseDBSource{DB: k.LeaseDB, UseIPv4: k.UseIPv4 == "true", UseIPv6: k.UseIPv6 == "true"})
+	}
 	return
 }
 
-func (k Kea) ControlAgentGetIPsForReservation(deviceName string) (ips []net.IP, err error) {
-	responseBody, err := k.MakeControlAgentRequest(
-		fmt.Sprintf(
-			KEA_LIST_RESERVATIONS_BY_HOSTNAME_TEMPLATE,
-			deviceName,
-			k.serviceNames()))
-
-	if err != nil {
-		return
+func (k Kea) sources() []Source {
+	if k.Sources != nil {
+		return k.Sources
 	}
+	return k.ConfiguredSources()
+}
+
+// LookupName queries every source concurrently for records with the given
+// hostname, and merges the results in source order. When several sources
+// return the same address, the first one wins, and when several backends
+// know the name, the one with the newest lease wins. A source which fails is
+// logged and skipped; an error is only returned when every source failed.
+// With CorrelateFamilies, the other family's addresses of the same client
+// are added when the name only has addresses of one. Finally the conflict
+// policy is applied.
+func (k Kea) LookupName(ctx context.Context, deviceName string) (records []Record, err error) {
+	return k.LookupNameFor(ctx, deviceName, dns.TypeANY)
+}
 
-	var reservationRecords KeaReservationRecords
-	err = json.Unmarshal(responseBody, &reservationRecords)
+// LookupNameFor is LookupName for a query of type qtype. With
+// correlate_families, records of the other family are only looked for when
+// an A or AAAA query found none of its own family.
+func (k Kea) LookupNameFor(ctx context.Context, deviceName string, qtype uint16) (records []Record, err error) {
+	records, err = k.lookup(ctx, func(ctx context.Context, source Source) ([]Record, error) {
+		return source.LookupName(ctx, deviceName)
+	})
 	if err != nil {
-		return
+		return nil, err
 	}
+	if k.CorrelateFamilies == "true" && !hasFamilyFor(records, qtype) {
+		records = k.correlate(ctx, records)
+	}
+	return k.ResolveConflicts(records), nil
+}
 
-	ipResult := new([]net.IP)
+// LookupAddr queries every source concurrently for records with the given
+// address, merged and filtered as LookupName does.
+func (k Kea) LookupAddr(ctx context.Context, ip net.IP) (records []Record, err error) {
+	return k.lookup(ctx, func(ctx context.Context, source Source) ([]Record, error) {
+		return source.LookupAddr(ctx, ip)
+	})
+}
 
-	for _, reservationRecord := range reservationRecords {
-		switch reservationRecord.Result {
-		case Success:
-			for _, lease := range reservationRecord.Arguments.Leases {
-				ip := net.ParseIP(lease.IPAddress)
-				if !ip.IsLoopback() {
-					*ipResult = append(*ipResult, ip)
-				}
+// LookupIdentifier queries every source which supports it for records with
+// the given hardware address, client-id or DUID, merged and filtered as
+// LookupName does.
+func (k Kea) LookupIdentifier(ctx context.Context, identifierType string, identifier string) (records []Record, err error) {
+	return k.lookup(ctx, func(ctx context.Context, source Source) ([]Record, error) {
+		if source, ok := source.(IdentifierSource); ok {
+			return source.LookupIdentifier(ctx, identifierType, identifier)
+		}
+		return nil, nil
+	})
+}
 
-				for _, innerIPString := range lease.IPAddresses {
-					innerIp := net.ParseIP(innerIPString)
-					if !innerIp.IsLoopback() {
-						*ipResult = append(*ipResult, ip)
-					}
-				}
+func (k Kea) lookup(ctx context.Context, query func(ctx context.Context, source Source) ([]Record, error)) (records []Record, err error) {
+	if k.LookupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, k.LookupTimeout)
+		defer cancel()
+	}
 
+	sources := k.sources()
+	results := make([][]Record, len(sources))
+	errs := make([]error, len(sources))
+
+	var wg sync.WaitGroup
+	for i, source := range sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			span, spanCtx := startSpan(ctx, "kea.lookup")
+			results[i], errs[i] = query(spanCtx, source)
+			finishLookupSpan(span, source, len(results[i]), errs[i])
+		}()
+	}
+	wg.Wait()
+
+	failed := 0
+	for i, source := range sources {
+		if errs[i] != nil {
+			errs[i] = k.sourceError(source, errs[i])
+			failed++
+			continue
+		}
+		for _, record := range results[i] {
+			if !slices.ContainsFunc(records, func(r Record) bool { return r.IP.Equal(record.IP) }) {
+				records = append(records, record)
 			}
-		case Error:
-			log.Warning("Kea reservation error: " + reservationRecord.Text)
 		}
 	}
 
-	ips, err = FilterIPsInCIDRs(ips, k.Networks)
+	if len(sources) > 0 && failed == len(sources) {
+		return nil, errors.Join(errs...)
+	}
+
+	records, err = k.FilterRecords(records)
 	if err != nil {
 		return nil, err
 	}
-
-	return
+	return MergeBackends(records), nil
 }
 
-func CompareCIDRs(subnet1 string, subnet2 string) bool {
-	_, net1, err := net.ParseCIDR(subnet1)
-	if err != nil {
-		return false
-	}
-	_, net2, err := net.ParseCIDR(subnet2)
-	if err != nil {
-		return false
-	}
-	return net1.String() == net2.String()
+// sourceError logs and counts a failed source lookup.
+func (k Kea) sourceError(source Source, err error) error {
+	log.Warningf("Lookup in %s failed: %v", sourceLabel(source), err)
+	sourceErrorCount.WithLabelValues(source.Name(), sourceBackend(source)).Inc()
+	return fmt.Errorf("%s: %w", sourceLabel(source), err)
 }
 
-func (k Kea) GetIPsForHostname(deviceName string) (ips []net.IP, err error) {
-	if k.ControlAgentLeases == "true" {
-		leases, err := k.ControlAgentGetIPsForLease(deviceName)
+// FilterRecords drops loopback addresses and, when networks is set,
+// addresses outside of the configured networks.
+func (k Kea) FilterRecords(records []Record) (filtered []Record, err error) {
+	var networks []*net.IPNet
+	for _, cidr := range k.Networks {
+		_, network, err := net.ParseCIDR(cidr)
 		if err != nil {
 			return nil, err
 		}
-		if len(leases) > 0 {
-			ips = append(ips, leases...)
-		}
+		networks = append(networks, network)
 	}
 
-	if k.ControlAgentReservations == "true" {
-		reservations, err := k.ControlAgentGetIPsForReservation(deviceName)
-		if err != nil {
-			return nil, err
+	for _, record := range records {
+		if record.IP == nil || record.IP.IsLoopback() {
+			continue
 		}
-		if len(reservations) > 0 {
-			ips = append(ips, reservations...)
+		if len(networks) > 0 && !ipInAnyNetwork(record.IP, networks) {
+			continue
 		}
+		filtered = append(filtered, record)
 	}
 
-	if k.DHCP4ConfPath != "" {
-		for _, subnet := range k.DHCP4Conf.Dhcp4.Subnet4 {
-			if slices.IndexFunc(k.Networks, func(n string) bool {
-				return CompareCIDRs(n, subnet.Subnet)
-			}) != -1 || len(k.Networks) == 0 {
-				for _, reservation := range subnet.Reservations {
-					if reservation.Hostname == deviceName {
-						ip := net.ParseIP(reservation.IpAddress)
-						if !ip.IsLoopback() {
-							ips = append(ips, ip)
-						}
-					}
-				}
-			}
-		}
-	}
+	return
+}
 
-	if k.DHCP6ConfPath != "" {
-		for _, subnet := range k.DHCP6Conf.Dhcp6.Subnet6 {
-			if slices.IndexFunc(k.Networks, func(n string) bool {
-				return CompareCIDRs(n, subnet.Subnet)
-			}) != -1 || len(k.Networks) == 0 {
-				for _, reservation := range subnet.Reservations {
-					if reservation.Hostname == deviceName {
-						for _, ipString := range reservation.IpAddresses {
-							ip := net.ParseIP(ipString)
-							if !ip.IsLoopback() {
-								ips = append(ips, ip)
-							}
-						}
-					}
-				}
-			}
-		}
+func (k Kea) GetIPsForHostname(deviceName string) (ips []net.IP, err error) {
+	records, err := k.LookupName(context.Background(), deviceName)
+	if err != nil {
+		return nil, err
 	}
+	return RecordIPs(records), nil
+}
 
-	return ips, nil
+func RecordIPs(records []Record) (ips []net.IP) {
+	for _, record := range records {
+		ips = append(ips, record.IP)
+	}
+	return
 }
 
 func FilterIPsInCIDRs(ips []net.IP, cidrs []string) (filteredIps []net.IP, err error) {
@@ -354,50 +426,6 @@ func ipInAnyNetwork(ip net.IP, networks []*net.IPNet) bool {
 	return false
 }
 
-type KeaResultCode int
-
-const (
-	Success KeaResultCode = iota
-	Error
-	Unsupported
-	NoContent
-)
-
-type KeaLeaseRecords []struct {
-	Arguments struct {
-		Leases []struct {
-			Cltt      int    `json:"cltt"`
-			FqdnFwd   bool   `json:"fqdn-fwd"`
-			FqdnRev   bool   `json:"fqdn-rev"`
-			Hostname  string `json:"hostname"`
-			HwAddress string `json:"hw-address"`
-			IPAddress string `json:"ip-address"`
-			State     int    `json:"state"`
-			SubnetID  int    `json:"subnet-id"`
-			ValidLft  int    `json:"valid-lft"`
-		} `json:"leases"`
-	} `json:"arguments,omitempty"`
-	Result KeaResultCode `json:"result"`
-	Text   string        `json:"text"`
-}
-
-// TODO: this is a guess from the docs. I don't yet have a Kea instance
-// running which supports reservation records in the control agent interface.
-// (It was a paid feature until 2.7.7/3.0.)
-type KeaReservationRecords []struct {
-	Arguments struct {
-		Leases []struct {
-			Hostname    string   `json:"hostname"`
-			HwAddress   string   `json:"hw-address"`
-			IPAddress   string   `json:"ip-address,omitempty"`
-			IPAddresses []string `json:"ip-addresses,omitempty"`
-			SubnetID    int      `json:"subnet-id"`
-		} `json:"leases"`
-	} `json:"arguments,omitempty"`
-	Result KeaResultCode `json:"result"`
-	Text   string        `json:"text"`
-}
-
 type KeaDHCP4Conf struct {
 	Dhcp4 struct {
 		Subnet4 []struct {
@@ -405,6 +433,7 @@ type KeaDHCP4Conf struct {
 			Reservations []struct {
 				IpAddress string `json:"ip-address"`
 				HwAddress string `json:"hw-address"`
+				ClientID  string `json:"client-id,omitempty"`
 				Hostname  string `json:"hostname,omitempty"`
 			} `json:"reservations,omitempty"`
 		} `json:"subnet4"`
@@ -418,6 +447,7 @@ type KeaDHCP6Conf struct {
 			Reservations []struct {
 				IpAddresses []string `json:"ip-addresses"`
 				HwAddress   string   `json:"hw-address"`
+				DUID        string   `json:"duid,omitempty"`
 				Hostname    string   `json:"hostname,omitempty"`
 			} `json:"reservations,omitempty"`
 		} `json:"subnet6"`
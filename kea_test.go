@@ -1,66 +1,55 @@
 package kea
 
 import (
+	"context"
 	"encoding/json"
 	"os"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
-	"github.com/joho/godotenv"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/ionothanus/coredns-kea/keaclient"
+	"github.com/ionothanus/coredns-kea/keatest"
+
+	"github.com/miekg/dns"
 )
 
-func TestMain(m *testing.M) {
-	err := godotenv.Load()
+// testFixture loads the leases and reservations served by fake Kea servers.
+func testFixture(t testing.TB) keatest.Fixture {
+	fixture, err := keatest.LoadFixture("./resources/kea-fixture.json")
 	if err != nil {
-		log.Fatalf("err loading: %v", err)
-	}
-
-	controlAgent = os.Getenv("CDNS_KEA_CONTROL_AGENT")
-	insecure = os.Getenv("CDNS_KEA_INSECURE")
-	leaseHostname = os.Getenv("CDNS_KEA_LEASE_HOSTNAME")
-	leaseIPv4 = os.Getenv("CDNS_KEA_LEASE_IP_V4")
-	reservationHostname = os.Getenv("CDNS_KEA_RESERVATION_HOSTNAME")
-	reservationIPv4 = os.Getenv("CDNS_KEA_RESERVATION_IP_V4")
-	awaitedAnswersIPv4 = os.Getenv("CDNS_KEA_AWAITED_ANSWERS_IP_V4")
-	leaseIPv6 = os.Getenv("CDNS_KEA_LEASE_IP_V6")
-	reservationIPv6 = os.Getenv("CDNS_KEA_RESERVATION_IP_V6")
-	awaitedAnswersIPv6 = os.Getenv("CDNS_KEA_AWAITED_ANSWERS_IP_V6")
-	includeReservationTests = os.Getenv("CDNS_KEA_INCLUDE_RESERVATION_TESTS")
-	includedNetworks = strings.Split(os.Getenv("CDNS_KEA_INCLUDED_NETWORKS"), " ")
-	excludedNetworks = strings.Split(os.Getenv("CDNS_KEA_EXCLUDED_NETWORKS"), " ")
-	useIPv4 = os.Getenv("CDNS_KEA_USE_IPV4")
-	useIPv6 = os.Getenv("CDNS_KEA_USE_IPV6")
-
-	os.Exit(m.Run())
+		t.Fatal(err)
+	}
+	return fixture
 }
 
-var (
-	controlAgent            string
-	insecure                string
-	leaseHostname           string
-	leaseIPv4               string
-	reservationHostname     string
-	reservationIPv4         string
-	awaitedAnswersIPv4      string
-	leaseIPv6               string
-	reservationIPv6         string
-	awaitedAnswersIPv6      string
-	includeReservationTests string
-	includedNetworks        []string
-	excludedNetworks        []string
-	useIPv4                 string
-	useIPv6                 string
-)
-
-func MakeTestKeaControlAgent() Kea {
+func MakeTestKeaControlAgent(t testing.TB) (Kea, *keatest.Server) {
+	server := keatest.NewControlAgent(t, testFixture(t))
 	return Kea{
-		ControlAgent:             controlAgent,
-		Insecure:                 insecure,
+		ControlAgents:            []string{server.URL},
+		Insecure:                 "false",
 		ControlAgentLeases:       "true",
-		ControlAgentReservations: includeReservationTests,
-		UseIPv4:                  useIPv4,
-		UseIPv6:                  useIPv6,
+		ControlAgentReservations: "true",
+		UseIPv4:                  "true",
+		UseIPv6:                  "true",
+	}, server
+}
+
+func hostnameIPs(t *testing.T, kea Kea, hostname string) string {
+	t.Helper()
+	info, err := kea.GetIPsForHostname(hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ips []string
+	for _, ip := range info {
+		ips = append(ips, ip.String())
 	}
+	return strings.Join(ips, " ")
 }
 
 func MakeTestKeaConfFiles() Kea {
@@ -92,91 +81,125 @@ func MakeTestKeaConfFiles() Kea {
 		DHCP6Conf:                dhcp6Conf,
 		ControlAgentLeases:       "false",
 		ControlAgentReservations: "false",
-		UseIPv4:                  useIPv4,
-		UseIPv6:                  useIPv6,
+		UseIPv4:                  "true",
+		UseIPv6:                  "true",
 	}
 }
 
 func TestGetIPsForLeaseHostname(t *testing.T) {
-	kea := MakeTestKeaControlAgent()
-	kea.ControlAgentLeases = "true"
+	kea, _ := MakeTestKeaControlAgent(t)
 	kea.ControlAgentReservations = "false"
 
-	info, err := kea.GetIPsForHostname(leaseHostname)
-
-	if err != nil {
-		t.Error(err)
-	}
-	if len(info) < 1 {
-		t.Log("Received no results")
-		t.FailNow()
-	}
-	found := false
-	for _, ip := range info {
-		t.Log(ip)
-		if ip.String() == leaseIPv4 || ip.String() == leaseIPv6 {
-			found = true
-		}
+	if ips := hostnameIPs(t, kea, "laptop"); ips != "10.0.0.20 2001:db8:1::20" {
+		t.Errorf("unexpected results %q", ips)
 	}
-	if !found {
-		t.Log("Did not find expected IP")
-		t.Fail()
+	if ips := hostnameIPs(t, kea, "LAPTOP"); ips != "10.0.0.20 2001:db8:1::20" {
+		t.Errorf("expected a case-insensitive match, got %q", ips)
 	}
 }
 
 func TestGetIPsForLeaseReservation(t *testing.T) {
-	if includeReservationTests != "true" {
-		t.Log("Skipping reservation test")
-		t.SkipNow()
+	kea, _ := MakeTestKeaControlAgent(t)
+	kea.ControlAgentLeases = "false"
+
+	if ips := hostnameIPs(t, kea, "nas"); ips != "10.0.0.160 2001:db8:1::160" {
+		t.Errorf("unexpected results %q", ips)
 	}
+}
 
-	kea := MakeTestKeaControlAgent()
-	kea.ControlAgentLeases = "false"
-	kea.ControlAgentReservations = "true"
-	info, err := kea.GetIPsForHostname(reservationHostname)
+func TestGetIPsWithIncludedNetworkFilter(t *testing.T) {
+	kea, _ := MakeTestKeaControlAgent(t)
+	kea.Networks = []string{"10.0.0.0/16"}
 
-	if err != nil {
-		t.Log("Received no results")
-		t.Error(err)
+	if ips := hostnameIPs(t, kea, "laptop"); ips != "10.0.0.20" {
+		t.Errorf("expected only the address inside networks, got %q", ips)
 	}
-	if len(info) < 1 {
-		t.FailNow()
+}
+
+func TestGetIPsWithExcludedNetworkFilter(t *testing.T) {
+	kea, _ := MakeTestKeaControlAgent(t)
+	kea.Networks = []string{"192.168.0.0/16", "2001:db8:ffff::/48"}
+
+	if ips := hostnameIPs(t, kea, "laptop"); ips != "" {
+		t.Errorf("expected no results outside networks, got %q", ips)
 	}
-	for _, ip := range info {
-		t.Log(ip)
+}
+
+func TestGetIPsWithHostnameNeedingEscaping(t *testing.T) {
+	kea, server := MakeTestKeaControlAgent(t)
+
+	hostname := `laptop", "x": "\`
+	if ips := hostnameIPs(t, kea, hostname); ips != "" {
+		t.Errorf("unexpected results %q", ips)
+	}
+	for _, request := range server.Requests() {
+		if request.Arguments["hostname"] != hostname || len(request.Arguments) != 1 {
+			t.Errorf("expected the hostname to be sent as is, got %v", request.Arguments)
+		}
 	}
-	t.Fail()
 }
 
-func TestGetIPsWithIncludedNetworkFilter(t *testing.T) {
-	kea := MakeTestKeaControlAgent()
-	kea.Networks = includedNetworks
-	kea.ControlAgentLeases = "true"
-	info, err := kea.GetIPsForHostname(leaseHostname)
+func TestGetIPsFromDaemonSockets(t *testing.T) {
+	fixture := testFixture(t)
+	dhcp4 := keatest.NewUnix(t, keatest.DHCP4, fixture)
+	dhcp6 := keatest.NewDirect(t, keatest.DHCP6, fixture)
 
-	if err != nil {
-		t.Error(err)
+	kea := Kea{
+		Endpoints:                NewEndpointPool([]string{dhcp4.URL, dhcp6.URL}, false, []string{KEA_IPV4_SERVICE_NAME, KEA_IPV6_SERVICE_NAME}, false),
+		ControlAgentLeases:       "true",
+		ControlAgentReservations: "true",
+		UseIPv4:                  "true",
+		UseIPv6:                  "true",
 	}
-	if len(info) < 1 {
-		t.Log("Received no results")
-		t.FailNow()
+	for _, endpoint := range kea.Endpoints.Endpoints {
+		endpoint.check(context.Background())
+		if capabilities := endpoint.Capabilities(); capabilities == nil || capabilities.Format != FormatDirect {
+			t.Fatalf("expected %s to be discovered as a daemon socket, got %v", endpoint.URL, capabilities)
+		}
 	}
-	for _, ip := range info {
-		t.Log(ip)
+
+	if ips := hostnameIPs(t, kea, "laptop"); ips != "10.0.0.20 2001:db8:1::20" {
+		t.Errorf("unexpected results %q", ips)
+	}
+	if ips := hostnameIPs(t, kea, "nas"); ips != "10.0.0.160 2001:db8:1::160" {
+		t.Errorf("unexpected results %q", ips)
+	}
+	if slices.Contains(dhcp4.Sent(), "lease6-get-by-hostname") || slices.Contains(dhcp6.Sent(), "lease4-get-by-hostname") {
+		t.Error("expected each lookup to go to the daemon for its family")
 	}
 }
 
-func TestGetIPsWithExcludedNetworkFilter(t *testing.T) {
-	kea := MakeTestKeaControlAgent()
-	kea.Networks = excludedNetworks
-	info, err := kea.GetIPsForHostname(leaseHostname)
+func TestGetIPsWithInjectedFaults(t *testing.T) {
+	kea, server := MakeTestKeaControlAgent(t)
+	kea.ControlAgentReservations = "false"
 
-	if err != nil {
-		t.Error(err)
+	// A failing daemon only loses its own address family.
+	server.Inject(keatest.Fault{Service: keatest.DHCP6, Result: keaclient.Error, Text: "server is shutting down"})
+	if ips := hostnameIPs(t, kea, "laptop"); ips != "10.0.0.20" {
+		t.Errorf("expected the IPv4 lease, got %q", ips)
 	}
-	if len(info) > 0 {
-		t.Log("Received unexpected result")
-		t.FailNow()
+
+	server.Reset()
+	server.Inject(keatest.Fault{Command: "lease4-get-by-hostname", Result: keaclient.Unsupported, Text: "'lease4-get-by-hostname' command not supported."})
+	if ips := hostnameIPs(t, kea, "laptop"); ips != "2001:db8:1::20" {
+		t.Errorf("expected the IPv6 lease, got %q", ips)
+	}
+
+	server.Reset()
+	server.Inject(keatest.Fault{HTTPStatus: 500})
+	if _, err := kea.GetIPsForHostname("laptop"); err == nil {
+		t.Error("expected an error when Kea answers with HTTP errors")
+	}
+
+	server.Reset()
+	server.Inject(keatest.Fault{Latency: time.Second})
+	kea.LookupTimeout = 50 * time.Millisecond
+	start := time.Now()
+	if _, err := kea.GetIPsForHostname("laptop"); err == nil {
+		t.Error("expected an error when Kea answers too late")
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("expected the lookup to stop at the deadline, took %v", elapsed)
 	}
 }
 
@@ -226,3 +249,81 @@ func TestGetIPsForConfFileReservationIPv6(t *testing.T) {
 		}
 	}
 }
+
+// fallthroughHandler answers NXDOMAIN, so tests can tell a query was
+// passed on to the next plugin.
+func fallthroughHandler() test.Handler {
+	return test.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNameError)
+		w.WriteMsg(m)
+		return dns.RcodeNameError, nil
+	})
+}
+
+func TestServeDNS(t *testing.T) {
+	kea, server := MakeTestKeaControlAgent(t)
+	kea.ExtractHostname = "true"
+	kea.Next = fallthroughHandler()
+
+	filtered := kea
+	filtered.Networks = []string{"10.0.0.0/16"}
+
+	tests := []struct {
+		kea   Kea
+		fault *keatest.Fault
+		test.Case
+	}{
+		{kea: kea, Case: test.Case{
+			Qname: "laptop.example.org.", Qtype: dns.TypeA, Authoritative: true,
+			Answer: []dns.RR{test.A("laptop.example.org. 60 IN A 10.0.0.20")},
+		}},
+		{kea: kea, Case: test.Case{
+			Qname: "laptop.example.org.", Qtype: dns.TypeAAAA, Authoritative: true,
+			Answer: []dns.RR{test.AAAA("laptop.example.org. 60 IN AAAA 2001:db8:1::20")},
+		}},
+		// Reservations are answered as well as leases.
+		{kea: kea, Case: test.Case{
+			Qname: "nas.example.org.", Qtype: dns.TypeA, Authoritative: true,
+			Answer: []dns.RR{test.A("nas.example.org. 60 IN A 10.0.0.160")},
+		}},
+		// Unknown names, other types and missing families fall through.
+		{kea: kea, Case: test.Case{Qname: "unknown.example.org.", Qtype: dns.TypeA, Rcode: dns.RcodeNameError}},
+		{kea: kea, Case: test.Case{Qname: "laptop.example.org.", Qtype: dns.TypeMX, Rcode: dns.RcodeNameError}},
+		{kea: kea, Case: test.Case{Qname: "printer.example.org.", Qtype: dns.TypeAAAA, Rcode: dns.RcodeNameError}},
+		// Addresses outside networks are filtered.
+		{kea: filtered, Case: test.Case{
+			Qname: "laptop.example.org.", Qtype: dns.TypeA, Authoritative: true,
+			Answer: []dns.RR{test.A("laptop.example.org. 60 IN A 10.0.0.20")},
+		}},
+		{kea: filtered, Case: test.Case{Qname: "laptop.example.org.", Qtype: dns.TypeAAAA, Rcode: dns.RcodeNameError}},
+		// Errors from Kea fall through.
+		{kea: kea, fault: &keatest.Fault{HTTPStatus: 500}, Case: test.Case{
+			Qname: "laptop.example.org.", Qtype: dns.TypeA, Rcode: dns.RcodeNameError,
+		}},
+	}
+
+	for i, tc := range tests {
+		server.Reset()
+		if tc.fault != nil {
+			server.Inject(*tc.fault)
+		}
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, err := tc.kea.ServeDNS(context.Background(), rec, tc.Msg())
+		if err != nil {
+			t.Errorf("Test %d: unexpected error %v", i, err)
+			continue
+		}
+		if rcode != tc.Rcode {
+			t.Errorf("Test %d: expected rcode %s, got %s", i, dns.RcodeToString[tc.Rcode], dns.RcodeToString[rcode])
+		}
+		if rec.Msg == nil {
+			t.Errorf("Test %d: no response written", i)
+			continue
+		}
+		if err := test.SortAndCheck(rec.Msg, tc.Case); err != nil {
+			t.Errorf("Test %d: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package keaclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+)
+
+// Lease is a lease as returned by the lease_cmds hook.
+type Lease struct {
+	ClientID  string `json:"client-id,omitempty"`
+	Cltt      int64  `json:"cltt"`
+	DUID      string `json:"duid,omitempty"`
+	FqdnFwd   bool   `json:"fqdn-fwd"`
+	FqdnRev   bool   `json:"fqdn-rev"`
+	Hostname  string `json:"hostname"`
+	HwAddress string `json:"hw-address"`
+	IPAddress string `json:"ip-address"`
+	State     int    `json:"state"`
+	SubnetID  int    `json:"subnet-id"`
+	ValidLft  int64  `json:"valid-lft"`
+}
+
+// Leases is the response to the leaseN-get-by-* and leaseN-get-all commands.
+type Leases struct {
+	Leases []Lease `json:"leases"`
+}
+
+// Host is a host reservation as returned by the host_cmds hook.
+type Host struct {
+	Hostname    string   `json:"hostname"`
+	HwAddress   string   `json:"hw-address,omitempty"`
+	ClientID    string   `json:"client-id,omitempty"`
+	DUID        string   `json:"duid,omitempty"`
+	IPAddress   string   `json:"ip-address,omitempty"`
+	IPAddresses []string `json:"ip-addresses,omitempty"`
+	SubnetID    int      `json:"subnet-id"`
+}
+
+// Hosts is the response to the reservation-get-by-* and reservation-get-all
+// commands.
+//
+// TODO: the host_cmds documentation lists the results under "hosts", which
+// hasn't been checked against a running Kea yet (host_cmds was a paid hook
+// until 2.7.7/3.0), so results under "leases" are accepted too.
+type Hosts struct {
+	Hosts  []Host `json:"hosts"`
+	Leases []Host `json:"leases"`
+}
+
+// Status is the response to status-get.
+type Status struct {
+	PID    int   `json:"pid"`
+	Uptime int64 `json:"uptime"`
+	Reload int64 `json:"reload"`
+}
+
+// HAHeartbeat is the response to ha-heartbeat.
+type HAHeartbeat struct {
+	State             string   `json:"state"`
+	DateTime          string   `json:"date-time"`
+	Scopes            []string `json:"scopes"`
+	UnsentUpdateCount int      `json:"unsent-update-count"`
+}
+
+// Statistics is the response to statistic-get-all: the samples Kea keeps of
+// each statistic, newest first.
+type Statistics map[string][]StatisticSample
+
+// Value returns the newest value of a numeric statistic.
+func (s Statistics) Value(name string) (value float64, ok bool) {
+	samples := s[name]
+	if len(samples) == 0 || !samples[0].Numeric {
+		return 0, false
+	}
+	return samples[0].Value, true
+}
+
+// StatisticSample is a value a statistic had, and when. Kea sends it as a
+// [value, timestamp] pair.
+type StatisticSample struct {
+	Value     float64
+	Timestamp string
+	// Numeric is false for statistics which aren't numbers, such as
+	// durations; Value is then 0.
+	Numeric bool
+}
+
+func (s *StatisticSample) UnmarshalJSON(data []byte) error {
+	var pair []json.RawMessage
+	if err := json.Unmarshal(data, &pair); err != nil {
+		return err
+	}
+	if len(pair) != 2 {
+		return fmt.Errorf("statistic sample has %d elements, expected 2", len(pair))
+	}
+	if err := json.Unmarshal(pair[1], &s.Timestamp); err != nil {
+		return err
+	}
+	s.Numeric = json.Unmarshal(pair[0], &s.Value) == nil
+	return nil
+}
+
+func (s StatisticSample) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{s.Value, s.Timestamp})
+}
+
+type hostnameArguments struct {
+	Hostname string `json:"hostname"`
+}
+
+type hwAddressArguments struct {
+	HwAddress string `json:"hw-address"`
+}
+
+type clientIDArguments struct {
+	ClientID string `json:"client-id"`
+}
+
+type duidArguments struct {
+	DUID string `json:"duid"`
+}
+
+type subnetIDArguments struct {
+	SubnetID int `json:"subnet-id"`
+}
+
+type addressArguments struct {
+	IPAddress string `json:"ip-address"`
+}
+
+// Client sends the commands this plugin uses.
+type Client struct {
+	Transport Transport
+}
+
+// LeaseGetByHostname sends lease4-get-by-hostname or lease6-get-by-hostname.
+func (c Client) LeaseGetByHostname(ctx context.Context, family int, hostname string, services ...string) ([]Reply[Leases], error) {
+	return Call[Leases](ctx, c.Transport, Command{
+		Command:   fmt.Sprintf("lease%d-get-by-hostname", family),
+		Service:   services,
+		Arguments: hostnameArguments{Hostname: hostname},
+	})
+}
+
+// LeaseGet sends lease4-get or lease6-get, as appropriate for the address.
+func (c Client) LeaseGet(ctx context.Context, ip net.IP, services ...string) ([]Reply[Lease], error) {
+	command := "lease4-get"
+	if ip.To4() == nil {
+		command = "lease6-get"
+	}
+	return Call[Lease](ctx, c.Transport, Command{
+		Command:   command,
+		Service:   services,
+		Arguments: addressArguments{IPAddress: ip.String()},
+	})
+}
+
+// LeaseGetByHwAddress sends lease4-get-by-hw-address. Kea has no DHCPv6
+// equivalent.
+func (c Client) LeaseGetByHwAddress(ctx context.Context, hwAddress string, services ...string) ([]Reply[Leases], error) {
+	return Call[Leases](ctx, c.Transport, Command{
+		Command:   "lease4-get-by-hw-address",
+		Service:   services,
+		Arguments: hwAddressArguments{HwAddress: hwAddress},
+	})
+}
+
+// LeaseGetByClientID sends lease4-get-by-client-id.
+func (c Client) LeaseGetByClientID(ctx context.Context, clientID string, services ...string) ([]Reply[Leases], error) {
+	return Call[Leases](ctx, c.Transport, Command{
+		Command:   "lease4-get-by-client-id",
+		Service:   services,
+		Arguments: clientIDArguments{ClientID: clientID},
+	})
+}
+
+// LeaseGetByDUID sends lease6-get-by-duid.
+func (c Client) LeaseGetByDUID(ctx context.Context, duid string, services ...string) ([]Reply[Leases], error) {
+	return Call[Leases](ctx, c.Transport, Command{
+		Command:   "lease6-get-by-duid",
+		Service:   services,
+		Arguments: duidArguments{DUID: duid},
+	})
+}
+
+// LeaseGetAll sends lease4-get-all or lease6-get-all, which return the
+// leases of every subnet.
+func (c Client) LeaseGetAll(ctx context.Context, family int, services ...string) ([]Reply[Leases], error) {
+	return Call[Leases](ctx, c.Transport, Command{
+		Command: fmt.Sprintf("lease%d-get-all", family),
+		Service: services,
+	})
+}
+
+// ReservationGetByHostname sends reservation-get-by-hostname.
+func (c Client) ReservationGetByHostname(ctx context.Context, hostname string, services ...string) ([]Reply[Hosts], error) {
+	return Call[Hosts](ctx, c.Transport, Command{
+		Command:   "reservation-get-by-hostname",
+		Service:   services,
+		Arguments: hostnameArguments{Hostname: hostname},
+	})
+}
+
+// ReservationGetByAddress sends reservation-get-by-address.
+func (c Client) ReservationGetByAddress(ctx context.Context, ip net.IP, services ...string) ([]Reply[Hosts], error) {
+	return Call[Hosts](ctx, c.Transport, Command{
+		Command:   "reservation-get-by-address",
+		Service:   services,
+		Arguments: addressArguments{IPAddress: ip.String()},
+	})
+}
+
+// ReservationGetAll sends reservation-get-all, which returns the
+// reservations of one subnet. Subnet ID 0 holds the global reservations.
+func (c Client) ReservationGetAll(ctx context.Context, subnetID int, services ...string) ([]Reply[Hosts], error) {
+	return Call[Hosts](ctx, c.Transport, Command{
+		Command:   "reservation-get-all",
+		Service:   services,
+		Arguments: subnetIDArguments{SubnetID: subnetID},
+	})
+}
+
+// StatusGet sends status-get.
+func (c Client) StatusGet(ctx context.Context, services ...string) ([]Reply[Status], error) {
+	return Call[Status](ctx, c.Transport, Command{Command: "status-get", Service: services})
+}
+
+// ListCommands sends list-commands, which lists the commands available.
+func (c Client) ListCommands(ctx context.Context, services ...string) ([]Reply[[]string], error) {
+	return Call[[]string](ctx, c.Transport, Command{Command: "list-commands", Service: services})
+}
+
+// VersionGet sends version-get. The version is the reply's Text.
+func (c Client) VersionGet(ctx context.Context, services ...string) ([]Reply[json.RawMessage], error) {
+	return Call[json.RawMessage](ctx, c.Transport, Command{Command: "version-get", Service: services})
+}
+
+// ConfigGet sends config-get. The configuration is keyed by daemon, such as
+// "Dhcp4".
+func (c Client) ConfigGet(ctx context.Context, services ...string) ([]Reply[map[string]json.RawMessage], error) {
+	return Call[map[string]json.RawMessage](ctx, c.Transport, Command{Command: "config-get", Service: services})
+}
+
+// HAHeartbeat sends ha-heartbeat, answered by the high_availability hook.
+func (c Client) HAHeartbeat(ctx context.Context, services ...string) ([]Reply[HAHeartbeat], error) {
+	return Call[HAHeartbeat](ctx, c.Transport, Command{Command: "ha-heartbeat", Service: services})
+}
+
+// StatisticGetAll sends statistic-get-all.
+func (c Client) StatisticGetAll(ctx context.Context, services ...string) ([]Reply[Statistics], error) {
+	return Call[Statistics](ctx, c.Transport, Command{Command: "statistic-get-all", Service: services})
+}
@@ -0,0 +1,171 @@
+// Package keaclient encodes commands for the Kea control API and decodes
+// their responses, whether sent through the control agent or straight to a
+// daemon's control socket.
+package keaclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ResultCode is the "result" of a Kea command response.
+type ResultCode int
+
+const (
+	Success ResultCode = iota
+	Error
+	Unsupported
+	NoContent
+	Conflict
+)
+
+func (r ResultCode) String() string {
+	switch r {
+	case Success:
+		return "success"
+	case Error:
+		return "error"
+	case Unsupported:
+		return "unsupported"
+	case NoContent:
+		return "empty"
+	case Conflict:
+		return "conflict"
+	}
+	return fmt.Sprintf("result %d", int(r))
+}
+
+var (
+	// ErrFailed matches a ResultError with the Error result.
+	ErrFailed = errors.New("command failed")
+	// ErrUnsupported matches a ResultError with the Unsupported result,
+	// returned when a command's hook library isn't loaded.
+	ErrUnsupported = errors.New("command not supported")
+	// ErrConflict matches a ResultError with the Conflict result.
+	ErrConflict = errors.New("command conflicted")
+)
+
+// ResultError is a response from Kea reporting that a command failed.
+type ResultError struct {
+	Command string
+	// Service is the daemon which answered, or empty for a direct request.
+	Service string
+	Result  ResultCode
+	Text    string
+}
+
+func (e *ResultError) Error() string {
+	prefix := e.Command
+	if e.Service != "" {
+		prefix = e.Service + " " + prefix
+	}
+	return fmt.Sprintf("%s: %s: %s", prefix, e.Result, e.Text)
+}
+
+func (e *ResultError) Is(target error) bool {
+	switch target {
+	case ErrFailed:
+		return e.Result == Error
+	case ErrUnsupported:
+		return e.Result == Unsupported
+	case ErrConflict:
+		return e.Result == Conflict
+	}
+	return false
+}
+
+// Command is a request to Kea. Service names the daemons the control agent
+// forwards it to, and is left out for a daemon's own control socket.
+type Command struct {
+	Command   string   `json:"command"`
+	Service   []string `json:"service,omitempty"`
+	Arguments any      `json:"arguments,omitempty"`
+}
+
+// Encode returns the JSON for a command.
+func Encode(command Command) (string, error) {
+	body, err := json.Marshal(command)
+	return string(body), err
+}
+
+// Reply is one service's response to a command.
+type Reply[T any] struct {
+	Command   string
+	Service   string
+	Result    ResultCode
+	Text      string
+	Arguments T
+}
+
+// Err returns a ResultError unless the command succeeded or found nothing.
+func (r Reply[T]) Err() error {
+	if r.Result == Success || r.Result == NoContent {
+		return nil
+	}
+	return &ResultError{Command: r.Command, Service: r.Service, Result: r.Result, Text: r.Text}
+}
+
+type response struct {
+	Result    ResultCode      `json:"result"`
+	Text      string          `json:"text"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// Decode parses the response to a command. The control agent answers with a
+// list holding a response for each service, in the order they were named; a
+// daemon answers with a single response.
+func Decode[T any](command Command, body []byte) (replies []Reply[T], err error) {
+	var responses []response
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+		responses = make([]response, 1)
+		err = json.Unmarshal(trimmed, &responses[0])
+	} else {
+		err = json.Unmarshal(body, &responses)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s response: %w", command.Command, err)
+	}
+
+	for i, response := range responses {
+		reply := Reply[T]{Command: command.Command, Result: response.Result, Text: response.Text}
+		if i < len(command.Service) {
+			reply.Service = command.Service[i]
+		}
+		// Arguments of failed commands don't follow the usual format.
+		if (response.Result == Success || response.Result == NoContent) && len(response.Arguments) > 0 && !bytes.Equal(response.Arguments, []byte("null")) {
+			if err = json.Unmarshal(response.Arguments, &reply.Arguments); err != nil {
+				return nil, fmt.Errorf("decoding %s arguments: %w", command.Command, err)
+			}
+		}
+		replies = append(replies, reply)
+	}
+	return replies, nil
+}
+
+// Transport sends an encoded command to Kea and returns the response body.
+type Transport interface {
+	Request(ctx context.Context, requestBody string) (responseBody []byte, err error)
+}
+
+// TransportFunc adapts a function to a Transport.
+type TransportFunc func(ctx context.Context, requestBody string) (responseBody []byte, err error)
+
+func (f TransportFunc) Request(ctx context.Context, requestBody string) ([]byte, error) {
+	return f(ctx, requestBody)
+}
+
+// Call encodes a command, sends it and decodes the replies.
+func Call[T any](ctx context.Context, transport Transport, command Command) ([]Reply[T], error) {
+	requestBody, err := Encode(command)
+	if err != nil {
+		return nil, err
+	}
+	responseBody, err := transport.Request(ctx, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	return Decode[T](command, responseBody)
+}
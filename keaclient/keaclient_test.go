@@ -0,0 +1,163 @@
+package keaclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+)
+
+// recordingTransport answers every command with a fixed body, keeping the
+// last request.
+type recordingTransport struct {
+	response string
+	request  string
+}
+
+func (t *recordingTransport) Request(ctx context.Context, requestBody string) ([]byte, error) {
+	t.request = requestBody
+	return []byte(t.response), nil
+}
+
+func TestEncodeEscapesArguments(t *testing.T) {
+	transport := &recordingTransport{response: `[{"result": 3, "text": "0 IPv4 lease(s) found.", "arguments": {"leases": []}}]`}
+	hostname := `laptop", "subnet-id": 1, "x": "\`
+	if _, err := (Client{transport}).LeaseGetByHostname(context.Background(), 4, hostname, "dhcp4"); err != nil {
+		t.Fatal(err)
+	}
+
+	var command struct {
+		Command   string   `json:"command"`
+		Service   []string `json:"service"`
+		Arguments map[string]any
+	}
+	if err := json.Unmarshal([]byte(transport.request), &command); err != nil {
+		t.Fatalf("request isn't valid JSON: %v\n%s", err, transport.request)
+	}
+	if command.Command != "lease4-get-by-hostname" || len(command.Arguments) != 1 || command.Arguments["hostname"] != hostname {
+		t.Errorf("unexpected request %s", transport.request)
+	}
+}
+
+func TestEncodeOmitsService(t *testing.T) {
+	body, err := Encode(Command{Command: "status-get"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != `{"command":"status-get"}` {
+		t.Errorf("unexpected request %s", body)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	command := Command{Command: "lease4-get", Service: []string{"dhcp4", "dhcp6"}}
+	body := `[
+		{"result": 0, "text": "IPv4 lease found.", "arguments": {"ip-address": "10.0.0.20", "hostname": "laptop", "cltt": 1700000000, "valid-lft": 3600}},
+		{"result": 3, "text": "Lease not found."},
+		{"result": 1, "text": "forwarding socket is not configured for the server type dhcp6"}
+	]`
+	replies, err := Decode[Lease](command, []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 3 {
+		t.Fatalf("expected 3 replies, got %d", len(replies))
+	}
+	if replies[0].Service != "dhcp4" || replies[0].Arguments.IPAddress != "10.0.0.20" || replies[0].Arguments.Cltt != 1700000000 {
+		t.Errorf("unexpected reply %+v", replies[0])
+	}
+	if replies[1].Err() != nil {
+		t.Errorf("expected no content not to be an error, got %v", replies[1].Err())
+	}
+	if err := replies[2].Err(); !errors.Is(err, ErrFailed) || errors.Is(err, ErrUnsupported) {
+		t.Errorf("expected a failed command error, got %v", err)
+	}
+
+	// A daemon's own socket answers with a single object.
+	replies, err = Decode[Lease](Command{Command: "lease6-get"}, []byte(`{"result": 2, "text": "'lease6-get' command not supported."}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resultErr *ResultError
+	if len(replies) != 1 || !errors.As(replies[0].Err(), &resultErr) || resultErr.Result != Unsupported || resultErr.Command != "lease6-get" {
+		t.Errorf("unexpected replies %+v", replies)
+	}
+
+	if _, err := Decode[Lease](command, []byte(`not json`)); err == nil {
+		t.Error("expected an error for an invalid response")
+	}
+}
+
+func TestLeaseGetCommand(t *testing.T) {
+	transport := &recordingTransport{response: `{"result": 3, "text": "Lease not found."}`}
+	replies, err := (Client{transport}).LeaseGet(context.Background(), net.ParseIP("2001:db8::20"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport.request != `{"command":"lease6-get","arguments":{"ip-address":"2001:db8::20"}}` {
+		t.Errorf("unexpected request %s", transport.request)
+	}
+	if len(replies) != 1 || replies[0].Result != NoContent {
+		t.Errorf("unexpected replies %+v", replies)
+	}
+}
+
+func TestResultCodeString(t *testing.T) {
+	for code, expected := range map[ResultCode]string{
+		Success: "success", Error: "error", Unsupported: "unsupported", NoContent: "empty", Conflict: "conflict", 9: "result 9",
+	} {
+		if code.String() != expected {
+			t.Errorf("expected %q, got %q", expected, code.String())
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	f.Add(`[{"result": 0, "text": "1 IPv4 lease(s) found.", "arguments": {"leases": [{"ip-address": "10.0.0.20", "hostname": "laptop", "cltt": 1700000000, "valid-lft": 3600}]}}]`)
+	f.Add(`{"result": 0, "text": "1 IPv4 host(s) found.", "arguments": {"hosts": [{"hostname": "nas", "ip-address": "10.0.0.160", "subnet-id": 1}]}}`)
+	f.Add(`{"result": 3, "text": "0 IPv6 lease(s) found.", "arguments": {"leases": []}}`)
+	f.Add(`[{"result": 1, "text": "forwarding socket is not configured for the server type dhcp6"}]`)
+	f.Add(`[]`)
+
+	command := Command{Command: "lease4-get-by-hostname", Service: []string{"dhcp4", "dhcp6"}}
+	f.Fuzz(func(t *testing.T, body string) {
+		leases, err := Decode[Leases](command, []byte(body))
+		if err == nil {
+			for i, reply := range leases {
+				if reply.Err() == nil && reply.Result != Success && reply.Result != NoContent {
+					t.Errorf("reply %d: result %s isn't an error", i, reply.Result)
+				}
+				if reply.Result != Success && reply.Result != NoContent && len(reply.Arguments.Leases) > 0 {
+					t.Errorf("reply %d: arguments decoded for result %s", i, reply.Result)
+				}
+			}
+		}
+		Decode[Hosts](command, []byte(body))
+	})
+}
+
+func TestDecodeStatistics(t *testing.T) {
+	body := `{"result": 0, "text": "", "arguments": {
+		"pkt4-received": [[125, "2024-05-01 10:11:19.498739"], [100, "2024-05-01 10:10:19.498739"]],
+		"subnet[1].total-nas": [[18446744073709551616, "2024-05-01 10:11:19.498739"]],
+		"reclaimed-leases-duration": [["00:00:00.000012", "2024-05-01 10:11:19.498739"]]
+	}}`
+	replies, err := Decode[Statistics](Command{Command: "statistic-get-all"}, []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	statistics := replies[0].Arguments
+	if value, ok := statistics.Value("pkt4-received"); !ok || value != 125 {
+		t.Errorf("expected the newest pkt4-received sample, got %v", value)
+	}
+	if value, ok := statistics.Value("subnet[1].total-nas"); !ok || value != 18446744073709551616 {
+		t.Errorf("expected a total-nas larger than an int64, got %v", value)
+	}
+	if _, ok := statistics.Value("reclaimed-leases-duration"); ok {
+		t.Error("expected a duration not to be numeric")
+	}
+	if _, ok := statistics.Value("missing"); ok {
+		t.Error("expected a missing statistic not to have a value")
+	}
+}
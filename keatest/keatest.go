@@ -0,0 +1,480 @@
+// Package keatest provides an in-process fake Kea for tests: a control
+// agent, a daemon's HTTP control socket or a daemon's UNIX control socket,
+// answering the commands this plugin sends from fixture leases and
+// reservations. Errors, latency and result codes can be injected.
+package keatest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ionothanus/coredns-kea/keaclient"
+)
+
+// Services the fake can run.
+const (
+	DHCP4 = "dhcp4"
+	DHCP6 = "dhcp6"
+)
+
+// Kinds of server the fake can pretend to be.
+const (
+	// ControlAgent forwards commands to the services named in "service"
+	// and answers with a list holding a response for each.
+	ControlAgent = "control_agent"
+	// Direct is a daemon's HTTP control socket (Kea 3.0 and later).
+	Direct = "direct"
+	// Unix is a daemon's UNIX control socket.
+	Unix = "unix"
+)
+
+// Commands lists what the fake supports when every hook is loaded.
+var Commands = []string{
+	"list-commands", "version-get", "status-get", "config-get",
+	"lease4-get", "lease4-get-all", "lease4-get-by-hostname", "lease4-get-by-hw-address", "lease4-get-by-client-id",
+	"lease6-get", "lease6-get-all", "lease6-get-by-hostname", "lease6-get-by-duid",
+	"reservation-get-all", "reservation-get-by-hostname", "reservation-get-by-address",
+	"statistic-get-all",
+}
+
+// Fixture holds the leases and reservations the fake answers from. Which
+// daemon holds a record follows from its address.
+type Fixture struct {
+	Leases []keaclient.Lease `json:"leases"`
+	Hosts  []keaclient.Host  `json:"hosts"`
+}
+
+// LoadFixture reads a fixture from a JSON file.
+func LoadFixture(path string) (fixture Fixture, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &fixture)
+	return
+}
+
+// Fault changes how the fake answers. Command and Service limit which
+// commands it applies to; empty matches every one.
+type Fault struct {
+	Command string
+	Service string
+	// Latency delays the answer.
+	Latency time.Duration
+	// HTTPStatus answers with an HTTP error instead, or closes a UNIX
+	// socket connection without an answer.
+	HTTPStatus int
+	// Result and Text replace the service's response when Result isn't
+	// Success.
+	Result keaclient.ResultCode
+	Text   string
+}
+
+// Request is a command the fake received.
+type Request struct {
+	Command   string
+	Service   []string
+	Arguments map[string]any
+}
+
+// Server is a fake Kea. Its exported fields may be changed before the first
+// request.
+type Server struct {
+	// URL is the address to send commands to; for a UNIX socket it is
+	// "unix://" followed by the socket's path.
+	URL  string
+	Kind string
+	// Services are the daemons answering behind a control agent; the others
+	// answer as if their control socket wasn't configured. A daemon's socket
+	// has exactly one.
+	Services []string
+	// Commands are the commands each service supports.
+	Commands []string
+	Version  string
+	// HA, if set, answers ha-heartbeat.
+	HA *keaclient.HAHeartbeat
+
+	fixture Fixture
+
+	mu         sync.Mutex
+	faults     []Fault
+	requests   []Request
+	statistics map[string]map[string]float64
+
+	http     *httptest.Server
+	listener net.Listener
+}
+
+func newServer(kind string, fixture Fixture, services ...string) *Server {
+	return &Server{
+		Kind:     kind,
+		Services: services,
+		Commands: slices.Clone(Commands),
+		Version:  "2.6.1",
+		fixture:  fixture,
+	}
+}
+
+// NewControlAgent starts a fake control agent with dhcp4 and dhcp6 behind it.
+func NewControlAgent(t testing.TB, fixture Fixture) *Server {
+	s := newServer(ControlAgent, fixture, DHCP4, DHCP6)
+	s.startHTTP(t)
+	return s
+}
+
+// NewDirect starts a fake daemon HTTP control socket for a service.
+func NewDirect(t testing.TB, service string, fixture Fixture) *Server {
+	s := newServer(Direct, fixture, service)
+	s.Version = "3.0.0"
+	s.startHTTP(t)
+	return s
+}
+
+// NewUnix starts a fake daemon UNIX control socket for a service.
+func NewUnix(t testing.TB, service string, fixture Fixture) *Server {
+	s := newServer(Unix, fixture, service)
+	path := filepath.Join(t.TempDir(), "kea-"+service+"-ctrl-socket")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.listener = listener
+	s.URL = "unix://" + path
+	go s.serveUnix()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *Server) startHTTP(t testing.TB) {
+	s.http = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.http.URL
+	t.Cleanup(s.Close)
+}
+
+// Close stops the server; later requests fail to connect.
+func (s *Server) Close() {
+	if s.http != nil {
+		s.http.Close()
+	}
+	if s.listener != nil {
+		s.listener.Close()
+	}
+}
+
+// Inject adds a fault. The first fault matching a command applies.
+func (s *Server) Inject(fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, fault)
+}
+
+// Reset removes every fault.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// RemoveCommands makes the services answer commands as unsupported, as if
+// the hook library providing them wasn't loaded.
+func (s *Server) RemoveCommands(commands ...string) {
+	s.Commands = slices.DeleteFunc(s.Commands, func(command string) bool {
+		return slices.Contains(commands, command)
+	})
+}
+
+// SetStatistics sets the values statistic-get-all answers with for a
+// service, replacing the previous ones.
+func (s *Server) SetStatistics(service string, statistics map[string]float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.statistics == nil {
+		s.statistics = map[string]map[string]float64{}
+	}
+	s.statistics[service] = statistics
+}
+
+// Requests returns the commands received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.requests)
+}
+
+// Sent returns the names of the commands received so far.
+func (s *Server) Sent() (commands []string) {
+	for _, request := range s.Requests() {
+		commands = append(commands, request.Command)
+	}
+	return
+}
+
+func (s *Server) fault(command string, service string) (fault Fault, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, fault := range s.faults {
+		if (fault.Command == "" || fault.Command == command) && (fault.Service == "" || fault.Service == service) {
+			return fault, true
+		}
+	}
+	return Fault{}, false
+}
+
+// handle answers a request body, returning nil when a fault asks for an
+// HTTP error, along with that status.
+func (s *Server) handle(ctx context.Context, body []byte) (response any, status int) {
+	var command struct {
+		Command   string         `json:"command"`
+		Service   []string       `json:"service"`
+		Arguments map[string]any `json:"arguments"`
+	}
+	if err := json.Unmarshal(body, &command); err != nil {
+		return map[string]any{"result": keaclient.Error, "text": "invalid command: " + err.Error()}, 0
+	}
+	request := Request{Command: command.Command, Service: command.Service, Arguments: command.Arguments}
+	s.mu.Lock()
+	s.requests = append(s.requests, request)
+	s.mu.Unlock()
+
+	if fault, ok := s.fault(request.Command, ""); ok {
+		if fault.Latency > 0 {
+			select {
+			case <-time.After(fault.Latency):
+			case <-ctx.Done():
+				return nil, http.StatusServiceUnavailable
+			}
+		}
+		if fault.HTTPStatus != 0 {
+			return nil, fault.HTTPStatus
+		}
+	}
+
+	if s.Kind != ControlAgent {
+		return s.answer(s.Services[0], request), 0
+	}
+	responses := []any{}
+	for _, service := range request.Service {
+		if !slices.Contains(s.Services, service) {
+			responses = append(responses, reply(keaclient.Error, "forwarding socket is not configured for the server type "+service, nil))
+			continue
+		}
+		responses = append(responses, s.answer(service, request))
+	}
+	return responses, 0
+}
+
+func reply(result keaclient.ResultCode, text string, arguments any) map[string]any {
+	response := map[string]any{"result": result, "text": text}
+	if arguments != nil {
+		response["arguments"] = arguments
+	}
+	return response
+}
+
+// answer is a service's response to a command.
+func (s *Server) answer(service string, request Request) map[string]any {
+	if fault, ok := s.fault(request.Command, service); ok && fault.Result != keaclient.Success {
+		return reply(fault.Result, fault.Text, nil)
+	}
+
+	family := "4"
+	if service == DHCP6 {
+		family = "6"
+	}
+	commands := slices.DeleteFunc(slices.Clone(s.Commands), func(command string) bool {
+		return strings.HasPrefix(command, "lease") && !strings.HasPrefix(command, "lease"+family)
+	})
+	if s.HA != nil {
+		commands = append(commands, "ha-heartbeat")
+	}
+	if !slices.Contains(commands, request.Command) {
+		return reply(keaclient.Unsupported, fmt.Sprintf("'%s' command not supported.", request.Command), nil)
+	}
+
+	hostname, _ := request.Arguments["hostname"].(string)
+	address, _ := request.Arguments["ip-address"].(string)
+	hwAddress, _ := request.Arguments["hw-address"].(string)
+	clientID, _ := request.Arguments["client-id"].(string)
+	duid, _ := request.Arguments["duid"].(string)
+	subnetID, hasSubnetID := request.Arguments["subnet-id"].(float64)
+	switch request.Command {
+	case "list-commands":
+		return reply(keaclient.Success, fmt.Sprintf("%d commands found", len(commands)), commands)
+	case "version-get":
+		return reply(keaclient.Success, s.Version, map[string]any{"extended": s.Version})
+	case "status-get":
+		return reply(keaclient.Success, "", keaclient.Status{PID: 1, Uptime: 10})
+	case "config-get":
+		// Only the subnets are configured; their IDs are those of the
+		// service's fixture leases and reservations.
+		var subnets []map[string]any
+		for _, id := range s.subnetIDs(service) {
+			subnets = append(subnets, map[string]any{"id": id})
+		}
+		return reply(keaclient.Success, "", map[string]any{"Dhcp" + family: map[string]any{"subnet" + family: subnets}})
+	case "ha-heartbeat":
+		return reply(keaclient.Success, "HA peer status returned.", s.HA)
+	case "statistic-get-all":
+		s.mu.Lock()
+		statistics := keaclient.Statistics{}
+		for name, value := range s.statistics[service] {
+			statistics[name] = []keaclient.StatisticSample{{Value: value, Timestamp: "2024-01-01 00:00:00.000000", Numeric: true}}
+		}
+		s.mu.Unlock()
+		return reply(keaclient.Success, "", statistics)
+	case "lease4-get-by-hostname", "lease6-get-by-hostname":
+		leases := s.leases(service, func(lease keaclient.Lease) bool { return strings.EqualFold(lease.Hostname, hostname) })
+		text := fmt.Sprintf("%d IPv%s lease(s) found.", len(leases), family)
+		if len(leases) == 0 {
+			return reply(keaclient.NoContent, text, keaclient.Leases{Leases: []keaclient.Lease{}})
+		}
+		return reply(keaclient.Success, text, keaclient.Leases{Leases: leases})
+	case "lease4-get-by-hw-address", "lease4-get-by-client-id", "lease6-get-by-duid":
+		leases := s.leases(service, func(lease keaclient.Lease) bool {
+			switch request.Command {
+			case "lease4-get-by-hw-address":
+				return lease.HwAddress != "" && strings.EqualFold(lease.HwAddress, hwAddress)
+			case "lease4-get-by-client-id":
+				return lease.ClientID != "" && strings.EqualFold(lease.ClientID, clientID)
+			}
+			return lease.DUID != "" && strings.EqualFold(lease.DUID, duid)
+		})
+		text := fmt.Sprintf("%d IPv%s lease(s) found.", len(leases), strings.TrimPrefix(service, "dhcp"))
+		if len(leases) == 0 {
+			return reply(keaclient.NoContent, text, keaclient.Leases{Leases: []keaclient.Lease{}})
+		}
+		return reply(keaclient.Success, text, keaclient.Leases{Leases: leases})
+	case "lease4-get-all", "lease6-get-all":
+		leases := s.leases(service, func(keaclient.Lease) bool { return true })
+		text := fmt.Sprintf("%d IPv%s lease(s) found.", len(leases), family)
+		if len(leases) == 0 {
+			return reply(keaclient.NoContent, text, keaclient.Leases{Leases: []keaclient.Lease{}})
+		}
+		return reply(keaclient.Success, text, keaclient.Leases{Leases: leases})
+	case "lease4-get", "lease6-get":
+		leases := s.leases(service, func(lease keaclient.Lease) bool { return sameIP(lease.IPAddress, address) })
+		if len(leases) == 0 {
+			return reply(keaclient.NoContent, "Lease not found.", nil)
+		}
+		return reply(keaclient.Success, "IPv"+family+" lease found.", leases[0])
+	case "reservation-get-all":
+		if !hasSubnetID {
+			return reply(keaclient.Error, "missing parameter 'subnet-id'", nil)
+		}
+		hosts := s.hosts(service, func(host keaclient.Host) bool { return host.SubnetID == int(subnetID) })
+		text := fmt.Sprintf("%d IPv%s host(s) found.", len(hosts), family)
+		if len(hosts) == 0 {
+			return reply(keaclient.NoContent, text, keaclient.Hosts{Hosts: []keaclient.Host{}})
+		}
+		return reply(keaclient.Success, text, map[string]any{"hosts": hosts})
+	case "reservation-get-by-hostname", "reservation-get-by-address":
+		hosts := s.hosts(service, func(host keaclient.Host) bool {
+			if request.Command == "reservation-get-by-hostname" {
+				return strings.EqualFold(host.Hostname, hostname)
+			}
+			return sameIP(host.IPAddress, address) || slices.ContainsFunc(host.IPAddresses, func(ip string) bool { return sameIP(ip, address) })
+		})
+		text := fmt.Sprintf("%d IPv%s host(s) found.", len(hosts), family)
+		if len(hosts) == 0 {
+			return reply(keaclient.NoContent, text, keaclient.Hosts{Hosts: []keaclient.Host{}})
+		}
+		return reply(keaclient.Success, text, map[string]any{"hosts": hosts})
+	}
+	return reply(keaclient.Unsupported, fmt.Sprintf("'%s' command not supported.", request.Command), nil)
+}
+
+func (s *Server) leases(service string, match func(keaclient.Lease) bool) (leases []keaclient.Lease) {
+	for _, lease := range s.fixture.Leases {
+		if serviceFor(lease.IPAddress) == service && match(lease) {
+			leases = append(leases, lease)
+		}
+	}
+	return
+}
+
+func (s *Server) hosts(service string, match func(keaclient.Host) bool) (hosts []keaclient.Host) {
+	for _, host := range s.fixture.Hosts {
+		address := host.IPAddress
+		if address == "" && len(host.IPAddresses) > 0 {
+			address = host.IPAddresses[0]
+		}
+		if serviceFor(address) == service && match(host) {
+			hosts = append(hosts, host)
+		}
+	}
+	return
+}
+
+// subnetIDs returns the IDs of the subnets holding a service's fixture
+// leases and reservations, other than the global reservations' 0.
+func (s *Server) subnetIDs(service string) (ids []int) {
+	for _, lease := range s.leases(service, func(keaclient.Lease) bool { return true }) {
+		ids = append(ids, lease.SubnetID)
+	}
+	for _, host := range s.hosts(service, func(keaclient.Host) bool { return true }) {
+		ids = append(ids, host.SubnetID)
+	}
+	slices.Sort(ids)
+	return slices.DeleteFunc(slices.Compact(ids), func(id int) bool { return id == 0 })
+}
+
+func serviceFor(address string) string {
+	if ip := net.ParseIP(address); ip != nil && ip.To4() == nil {
+		return DHCP6
+	}
+	return DHCP4
+}
+
+func sameIP(a string, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	return ipA != nil && ipA.Equal(ipB)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	response, status := s.handle(r.Context(), body)
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// serveUnix answers one command per connection and then closes it, as Kea
+// does.
+func (s *Server) serveUnix() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var body json.RawMessage
+			if err := json.NewDecoder(conn).Decode(&body); err != nil {
+				return
+			}
+			response, status := s.handle(context.Background(), body)
+			if status != 0 {
+				return
+			}
+			json.NewEncoder(conn).Encode(response)
+		}()
+	}
+}
@@ -0,0 +1,114 @@
+package keatest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ionothanus/coredns-kea/keaclient"
+)
+
+var testFixture = Fixture{
+	Leases: []keaclient.Lease{
+		{IPAddress: "10.0.0.20", Hostname: "laptop"},
+		{IPAddress: "2001:db8::20", Hostname: "laptop"},
+	},
+	Hosts: []keaclient.Host{
+		{IPAddress: "10.0.0.150", Hostname: "nas"},
+	},
+}
+
+// httpTransport posts commands to an HTTP server.
+func httpTransport(url string) keaclient.Transport {
+	return keaclient.TransportFunc(func(ctx context.Context, requestBody string) ([]byte, error) {
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(requestBody))
+		if err != nil {
+			return nil, err
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return nil, errors.New(response.Status)
+		}
+		return io.ReadAll(response.Body)
+	})
+}
+
+// unixTransport sends commands to a UNIX socket server.
+func unixTransport(url string) keaclient.Transport {
+	return keaclient.TransportFunc(func(ctx context.Context, requestBody string) ([]byte, error) {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "unix", strings.TrimPrefix(url, "unix://"))
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		if _, err := io.WriteString(conn, requestBody); err != nil {
+			return nil, err
+		}
+		return io.ReadAll(conn)
+	})
+}
+
+func TestControlAgent(t *testing.T) {
+	server := NewControlAgent(t, testFixture)
+	server.Services = []string{DHCP4}
+	client := keaclient.Client{Transport: httpTransport(server.URL)}
+	ctx := context.Background()
+
+	replies, err := client.LeaseGetByHostname(ctx, 4, "LAPTOP", DHCP4, DHCP6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 2 || len(replies[0].Arguments.Leases) != 1 || replies[0].Arguments.Leases[0].IPAddress != "10.0.0.20" {
+		t.Errorf("unexpected replies %+v", replies)
+	}
+	if !errors.Is(replies[1].Err(), keaclient.ErrFailed) {
+		t.Errorf("expected dhcp6 not to be configured, got %v", replies[1].Err())
+	}
+
+	server.Inject(Fault{Command: "reservation-get-by-hostname", Result: keaclient.Unsupported, Text: "not loaded"})
+	hosts, err := client.ReservationGetByHostname(ctx, "nas", DHCP4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(hosts[0].Err(), keaclient.ErrUnsupported) {
+		t.Errorf("expected the injected result, got %+v", hosts[0])
+	}
+
+	server.Inject(Fault{HTTPStatus: 503})
+	if _, err := client.StatusGet(ctx, DHCP4); err == nil {
+		t.Error("expected an HTTP error")
+	}
+	if sent := server.Sent(); len(sent) != 3 {
+		t.Errorf("expected 3 requests, got %v", sent)
+	}
+}
+
+func TestUnix(t *testing.T) {
+	server := NewUnix(t, DHCP6, testFixture)
+	client := keaclient.Client{Transport: unixTransport(server.URL)}
+
+	replies, err := client.LeaseGet(context.Background(), net.ParseIP("2001:db8::20"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 1 || replies[0].Result != keaclient.Success || replies[0].Arguments.Hostname != "laptop" {
+		t.Errorf("unexpected replies %+v", replies)
+	}
+
+	replies, err = client.LeaseGet(context.Background(), net.ParseIP("10.0.0.20"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(replies[0].Err(), keaclient.ErrUnsupported) {
+		t.Errorf("expected a dhcp6 socket not to answer lease4-get, got %+v", replies[0])
+	}
+}
@@ -0,0 +1,272 @@
+package kea
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
+
+const LEASE_DB_MYSQL = "mysql"
+const LEASE_DB_POSTGRESQL = "postgresql"
+
+// leaseDBDrivers maps Kea's lease-database type names to database/sql drivers.
+var leaseDBDrivers = map[string]string{
+	LEASE_DB_MYSQL:      "mysql",
+	LEASE_DB_POSTGRESQL: "postgres",
+}
+
+const leaseDBLease4Columns = "address, hwaddr, client_id, valid_lifetime, expire, subnet_id, hostname, state"
+const leaseDBLease6Columns = "address, hwaddr, duid, valid_lifetime, expire, subnet_id, hostname, state"
+
+// The time format MySQL uses for TIMESTAMP columns when the driver doesn't
+// convert them; Kea writes them in local time.
+const leaseDBTimeFormat = "2006-01-02 15:04:05"
+
+// LeaseDB reads leases from the lease4 and lease6 tables of a Kea MySQL or
+// PostgreSQL lease database.
+type LeaseDB struct {
+	Type string
+	DB   *sql.DB
+
+	reached atomic.Bool
+	loop    loop
+}
+
+func OpenLeaseDB(dbType string, dataSourceName string) (*LeaseDB, error) {
+	driver, ok := leaseDBDrivers[dbType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported lease database type %q", dbType)
+	}
+	db, err := sql.Open(driver, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	return &LeaseDB{Type: dbType, DB: db}, nil
+}
+
+func (l *LeaseDB) Close() error { return l.DB.Close() }
+
+// Reached reports whether the database has ever answered a health check.
+func (l *LeaseDB) Reached() bool { return l.reached.Load() }
+
+// check pings the database and records the result.
+func (l *LeaseDB) check(ctx context.Context) {
+	if err := l.DB.PingContext(ctx); err != nil {
+		log.Warningf("Kea %s lease database is unreachable: %v", l.Type, err)
+		endpointHealthy.WithLabelValues(SourceLeaseDB + ":" + l.Type).Set(0)
+		return
+	}
+	if !l.reached.Swap(true) {
+		log.Infof("Kea %s lease database is reachable", l.Type)
+	}
+	endpointHealthy.WithLabelValues(SourceLeaseDB + ":" + l.Type).Set(1)
+}
+
+// Start checks the database's health now and then periodically.
+func (l *LeaseDB) Start() {
+	l.loop.start(healthCheckInterval, healthCheckInterval, true, l.check)
+}
+
+// Stop ends the checks started by Start.
+func (l *LeaseDB) Stop() {
+	l.loop.stop()
+}
+
+func (l *LeaseDB) placeholder(n int) string {
+	if l.Type == LEASE_DB_POSTGRESQL {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+// GetLeasesForHostname returns the active leases of one address family with
+// the given hostname. Kea lower-cases hostnames before searching, so this
+// does as well.
+func (l *LeaseDB) GetLeasesForHostname(ctx context.Context, hostname string, family int) (leases []Lease, err error) {
+	hostname = strings.ToLower(hostname)
+
+	if family == 4 {
+		return l.queryLeases(ctx,
+			"SELECT "+leaseDBLease4Columns+" FROM lease4 WHERE hostname = "+l.placeholder(1)+
+				" AND state = 0 AND expire > CURRENT_TIMESTAMP",
+			hostname)
+	}
+	return l.queryLeases(ctx,
+		"SELECT "+leaseDBLease6Columns+" FROM lease6 WHERE hostname = "+l.placeholder(1)+
+			" AND state = 0 AND lease_type = 0 AND expire > CURRENT_TIMESTAMP",
+		hostname)
+}
+
+// GetLeasesForIP returns the active lease for the given address, if any.
+func (l *LeaseDB) GetLeasesForIP(ctx context.Context, ip net.IP) (leases []Lease, err error) {
+	if ip4 := ip.To4(); ip4 != nil {
+		// Both backends store IPv4 addresses as integers.
+		return l.queryLeases(ctx,
+			"SELECT "+leaseDBLease4Columns+" FROM lease4 WHERE address = "+l.placeholder(1)+
+				" AND state = 0 AND expire > CURRENT_TIMESTAMP",
+			int64(binary.BigEndian.Uint32(ip4)))
+	}
+	return l.queryLeases(ctx,
+		"SELECT "+leaseDBLease6Columns+" FROM lease6 WHERE address = "+l.placeholder(1)+
+			" AND state = 0 AND lease_type = 0 AND expire > CURRENT_TIMESTAMP",
+		ip.String())
+}
+
+// leaseDBIdentifierColumns names the column holding each type of identifier,
+// by address family.
+var leaseDBIdentifierColumns = map[string]map[int]string{
+	IdentifierHwAddress: {4: "hwaddr", 6: "hwaddr"},
+	IdentifierClientID:  {4: "client_id"},
+	IdentifierDUID:      {6: "duid"},
+}
+
+// GetLeasesForIdentifier returns the active leases of one address family with
+// the given hardware address, client-id or DUID. A family without that type
+// of identifier has none.
+func (l *LeaseDB) GetLeasesForIdentifier(ctx context.Context, identifierType string, identifier string, family int) (leases []Lease, err error) {
+	column, ok := leaseDBIdentifierColumns[identifierType][family]
+	if !ok {
+		return nil, nil
+	}
+	// Identifiers are stored as binary.
+	value, err := hex.DecodeString(normalizeIdentifier(identifier))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", identifierType, identifier)
+	}
+
+	if family == 4 {
+		return l.queryLeases(ctx,
+			"SELECT "+leaseDBLease4Columns+" FROM lease4 WHERE "+column+" = "+l.placeholder(1)+
+				" AND state = 0 AND expire > CURRENT_TIMESTAMP",
+			value)
+	}
+	return l.queryLeases(ctx,
+		"SELECT "+leaseDBLease6Columns+" FROM lease6 WHERE "+column+" = "+l.placeholder(1)+
+			" AND state = 0 AND lease_type = 0 AND expire > CURRENT_TIMESTAMP",
+		value)
+}
+
+func (l *LeaseDB) queryLeases(ctx context.Context, query string, args ...any) (leases []Lease, err error) {
+	rows, err := l.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var address, hwaddr, clientID, expire any
+		var validLft, subnetID, state sql.NullInt64
+		var hostname sql.NullString
+		err = rows.Scan(&address, &hwaddr, &clientID, &validLft, &expire, &subnetID, &hostname, &state)
+		if err != nil {
+			return nil, err
+		}
+
+		ip, err := DecodeLeaseDBAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		expireTime, err := DecodeLeaseDBTime(expire)
+		if err != nil {
+			return nil, err
+		}
+
+		leases = append(leases, Lease{
+			IPAddress: ip.String(),
+			HwAddress: decodeLeaseDBIdentifier(hwaddr),
+			ClientID:  decodeLeaseDBIdentifier(clientID),
+			ValidLft:  validLft.Int64,
+			Expire:    expireTime.Unix(),
+			SubnetID:  int(subnetID.Int64),
+			Hostname:  hostname.String,
+			State:     int(state.Int64),
+		})
+	}
+
+	return leases, rows.Err()
+}
+
+// DecodeLeaseDBAddress decodes a lease address column. IPv4 addresses are
+// stored as integers; IPv6 addresses are text in MySQL, INET in PostgreSQL
+// and 16-byte binary in some schema versions.
+func DecodeLeaseDBAddress(value any) (net.IP, error) {
+	switch v := value.(type) {
+	case int64:
+		return uint32ToIP(uint32(v)), nil
+	case uint64:
+		return uint32ToIP(uint32(v)), nil
+	case string:
+		return DecodeLeaseDBAddress([]byte(v))
+	case []byte:
+		text := strings.TrimSpace(string(v))
+		if n, err := strconv.ParseUint(text, 10, 32); err == nil {
+			return uint32ToIP(uint32(n)), nil
+		}
+		// PostgreSQL renders INET values with a prefix length when it isn't /128.
+		text, _, _ = strings.Cut(text, "/")
+		if ip := net.ParseIP(text); ip != nil {
+			return ip, nil
+		}
+		if len(v) == net.IPv6len || len(v) == net.IPv4len {
+			return net.IP(append([]byte(nil), v...)), nil
+		}
+	}
+	return nil, fmt.Errorf("cannot decode lease address %v", value)
+}
+
+// DecodeLeaseDBTime decodes an expire column, which drivers return either as
+// a time.Time or as text when they don't parse timestamps.
+func DecodeLeaseDBTime(value any) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case int64:
+		return time.Unix(v, 0), nil
+	case string:
+		return DecodeLeaseDBTime([]byte(v))
+	case []byte:
+		text := string(v)
+		if t, err := time.ParseInLocation(leaseDBTimeFormat, text, time.Local); err == nil {
+			return t, nil
+		}
+		if t, err := time.Parse(time.RFC3339Nano, text); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot decode lease expire time %v", value)
+}
+
+// decodeLeaseDBIdentifier formats a binary hardware address, client-id or
+// DUID column the way Kea prints them.
+func decodeLeaseDBIdentifier(value any) string {
+	var b []byte
+	switch v := value.(type) {
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return ""
+	}
+	parts := make([]string, len(b))
+	for i := range b {
+		parts[i] = hex.EncodeToString(b[i : i+1])
+	}
+	return strings.Join(parts, ":")
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
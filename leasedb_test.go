@@ -0,0 +1,245 @@
+package kea
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSQLDriver stands in for a MySQL or PostgreSQL driver. Each query is
+// recorded and answered with the rows returned by the current handler.
+type fakeSQLDriver struct {
+	mu      sync.Mutex
+	queries []fakeSQLQuery
+	handler func(query string, args []driver.NamedValue) [][]driver.Value
+}
+
+type fakeSQLQuery struct {
+	query string
+	args  []driver.NamedValue
+}
+
+var testSQLDriver = &fakeSQLDriver{}
+
+func init() { sql.Register("kea-fake", testSQLDriver) }
+
+func (d *fakeSQLDriver) Open(string) (driver.Conn, error) { return fakeSQLConn{d}, nil }
+
+type fakeSQLConn struct{ driver *fakeSQLDriver }
+
+func (c fakeSQLConn) Prepare(string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (c fakeSQLConn) Close() error                        { return nil }
+func (c fakeSQLConn) Begin() (driver.Tx, error)           { return nil, driver.ErrSkip }
+
+func (c fakeSQLConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.driver.mu.Lock()
+	defer c.driver.mu.Unlock()
+	c.driver.queries = append(c.driver.queries, fakeSQLQuery{query, args})
+	var rows [][]driver.Value
+	if c.driver.handler != nil {
+		rows = c.driver.handler(query, args)
+	}
+	return &fakeSQLRows{rows: rows}, nil
+}
+
+type fakeSQLRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeSQLRows) Columns() []string {
+	return strings.Split(leaseDBLease4Columns, ", ")
+}
+
+func (r *fakeSQLRows) Close() error { return nil }
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func makeTestLeaseDB(t *testing.T, dbType string, handler func(query string, args []driver.NamedValue) [][]driver.Value) *LeaseDB {
+	testSQLDriver.mu.Lock()
+	testSQLDriver.queries = nil
+	testSQLDriver.handler = handler
+	testSQLDriver.mu.Unlock()
+
+	db, err := sql.Open("kea-fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &LeaseDB{Type: dbType, DB: db}
+}
+
+func TestLeaseDBGetIPsForHostname(t *testing.T) {
+	expire := time.Now().Add(time.Hour)
+	leaseDB := makeTestLeaseDB(t, LEASE_DB_MYSQL, func(query string, args []driver.NamedValue) [][]driver.Value {
+		if args[0].Value != "laptop" {
+			return nil
+		}
+		if strings.Contains(query, "FROM lease4") {
+			return [][]driver.Value{
+				{int64(167772180), []byte{0, 0x11, 0x22, 0x33, 0x44, 0x66}, nil, int64(3600), []byte(expire.Format(leaseDBTimeFormat)), int64(1), "laptop", int64(0)},
+				{int64(2130706433), nil, nil, int64(3600), expire, int64(1), "laptop", int64(0)},
+			}
+		}
+		return [][]driver.Value{
+			{"2001:db8:1::20", nil, []byte{0, 3, 0, 1, 0, 0x11, 0x22, 0x33, 0x44, 0x66}, int64(3600), expire, int64(1), "laptop", int64(0)},
+		}
+	})
+
+	kea := Kea{LeaseDB: leaseDB, UseIPv4: "true", UseIPv6: "true"}
+	info, err := kea.GetIPsForHostname("Laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ips []string
+	for _, ip := range info {
+		ips = append(ips, ip.String())
+	}
+	if strings.Join(ips, " ") != "10.0.0.20 2001:db8:1::20" {
+		t.Errorf("unexpected results %v", ips)
+	}
+
+	for _, query := range testSQLDriver.queries {
+		if !strings.Contains(query.query, "hostname = ?") {
+			t.Errorf("expected MySQL placeholder in %q", query.query)
+		}
+	}
+
+	kea.Networks = []string{"2001:db8::/32"}
+	info, err = kea.GetIPsForHostname("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info) != 1 || info[0].String() != "2001:db8:1::20" {
+		t.Errorf("expected only the IPv6 lease inside networks, got %v", info)
+	}
+}
+
+func TestLeaseDBGetLeasesForIP(t *testing.T) {
+	expire := time.Now().Add(time.Hour)
+	leaseDB := makeTestLeaseDB(t, LEASE_DB_POSTGRESQL, func(query string, args []driver.NamedValue) [][]driver.Value {
+		if strings.Contains(query, "FROM lease4") && args[0].Value == int64(167772180) {
+			return [][]driver.Value{
+				{int64(167772180), []byte{0, 0x11, 0x22, 0x33, 0x44, 0x66}, []byte{1, 0, 0x11, 0x22, 0x33, 0x44, 0x66}, int64(3600), expire, int64(1), "laptop", int64(0)},
+			}
+		}
+		if strings.Contains(query, "FROM lease6") && args[0].Value == "2001:db8:1::20" {
+			return [][]driver.Value{
+				{[]byte("2001:db8:1::20/128"), nil, nil, int64(3600), expire, int64(1), "laptop", int64(0)},
+			}
+		}
+		return nil
+	})
+
+	leases, err := leaseDB.GetLeasesForIP(context.Background(), net.ParseIP("10.0.0.20"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 1 {
+		t.Fatalf("expected 1 lease, got %d", len(leases))
+	}
+	lease := leases[0]
+	if lease.IPAddress != "10.0.0.20" || lease.HwAddress != "00:11:22:33:44:66" ||
+		lease.ClientID != "01:00:11:22:33:44:66" || lease.Cltt() != expire.Unix()-3600 {
+		t.Errorf("unexpected lease %+v", lease)
+	}
+
+	leases, err = leaseDB.GetLeasesForIP(context.Background(), net.ParseIP("2001:db8:1::20"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 1 || leases[0].IPAddress != "2001:db8:1::20" {
+		t.Errorf("unexpected leases %+v", leases)
+	}
+
+	if !strings.Contains(testSQLDriver.queries[0].query, "address = $1") {
+		t.Errorf("expected PostgreSQL placeholder in %q", testSQLDriver.queries[0].query)
+	}
+}
+
+func TestLeaseDBGetLeasesForIdentifier(t *testing.T) {
+	expire := time.Now().Add(time.Hour)
+	leaseDB := makeTestLeaseDB(t, LEASE_DB_MYSQL, func(query string, args []driver.NamedValue) [][]driver.Value {
+		if strings.Contains(query, "FROM lease4 WHERE hwaddr = ?") && string(args[0].Value.([]byte)) == string([]byte{0, 0x11, 0x22, 0x33, 0x44, 0x66}) {
+			return [][]driver.Value{
+				{int64(167772180), []byte{0, 0x11, 0x22, 0x33, 0x44, 0x66}, nil, int64(3600), expire, int64(1), "laptop", int64(0)},
+			}
+		}
+		return nil
+	})
+
+	kea := Kea{LeaseDB: leaseDB, UseIPv4: "true", UseIPv6: "true"}
+	records, err := kea.LookupIdentifier(context.Background(), IdentifierHwAddress, "00:11:22:33:44:66")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].IP.String() != "10.0.0.20" {
+		t.Errorf("unexpected records %+v", records)
+	}
+
+	// Client-ids are only in lease4, and DUIDs only in lease6.
+	testSQLDriver.queries = nil
+	if _, err := kea.LookupIdentifier(context.Background(), IdentifierDUID, "00:03:00:01:00:11:22:33:44:66"); err != nil {
+		t.Fatal(err)
+	}
+	if len(testSQLDriver.queries) != 1 || !strings.Contains(testSQLDriver.queries[0].query, "FROM lease6 WHERE duid = ?") {
+		t.Errorf("expected a single lease6 query, got %+v", testSQLDriver.queries)
+	}
+}
+
+func TestDecodeLeaseDBAddress(t *testing.T) {
+	tests := []struct {
+		value    any
+		expected string
+	}{
+		{int64(167772180), "10.0.0.20"},
+		{uint64(167772180), "10.0.0.20"},
+		{[]byte("167772180"), "10.0.0.20"},
+		{"2001:db8::1", "2001:db8::1"},
+		{[]byte("2001:db8::1/128"), "2001:db8::1"},
+		{[]byte(net.ParseIP("2001:db8::1")), "2001:db8::1"},
+	}
+	for _, test := range tests {
+		ip, err := DecodeLeaseDBAddress(test.value)
+		if err != nil {
+			t.Errorf("%v: %v", test.value, err)
+			continue
+		}
+		if ip.String() != test.expected {
+			t.Errorf("%v: expected %s, got %s", test.value, test.expected, ip)
+		}
+	}
+
+	if _, err := DecodeLeaseDBAddress([]byte("not an address")); err == nil {
+		t.Error("expected an error for an invalid address")
+	}
+}
+
+func FuzzDecodeLeaseDBAddress(f *testing.F) {
+	f.Add([]byte("167772180"))
+	f.Add([]byte("2001:db8:1::20"))
+	f.Add([]byte("2001:db8:1::/64"))
+	f.Add([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x20})
+	f.Add([]byte("not an address"))
+
+	f.Fuzz(func(t *testing.T, value []byte) {
+		ip, err := DecodeLeaseDBAddress(value)
+		if err == nil && len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+			t.Errorf("decoded %q to an invalid address %v", value, []byte(ip))
+		}
+		DecodeLeaseDBTime(value)
+		decodeLeaseDBIdentifier(value)
+	})
+}
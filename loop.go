@@ -0,0 +1,50 @@
+package kea
+
+import (
+	"context"
+	"time"
+)
+
+// loop runs background work periodically until stopped: the health checks,
+// lease file tailing, statistics and inventory each run in one.
+type loop struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// start calls run every interval, first right away when immediate is set.
+// Each call's context times out after timeout, and is cancelled by stop.
+func (l *loop) start(interval time.Duration, timeout time.Duration, immediate bool, run func(ctx context.Context)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	l.cancel = cancel
+	l.done = make(chan struct{})
+	go func() {
+		defer close(l.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if immediate {
+				runCtx, cancelRun := context.WithTimeout(ctx, timeout)
+				run(runCtx)
+				cancelRun()
+			}
+			immediate = true
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// stop ends the loop started by start, and waits for a call in progress to
+// return.
+func (l *loop) stop() {
+	if l.cancel == nil {
+		return
+	}
+	l.cancel()
+	<-l.done
+	l.cancel = nil
+}
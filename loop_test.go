@@ -0,0 +1,39 @@
+package kea
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLoop(t *testing.T) {
+	runs := make(chan time.Duration, 10)
+	var l loop
+	l.start(10*time.Millisecond, time.Hour, false, func(ctx context.Context) {
+		deadline, _ := ctx.Deadline()
+		runs <- time.Until(deadline)
+		<-ctx.Done()
+	})
+
+	select {
+	case remaining := <-runs:
+		if remaining <= 0 || remaining > time.Hour {
+			t.Errorf("expected the run to time out within an hour, got %v", remaining)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a run after the interval")
+	}
+
+	// Stop cancels the run in progress rather than waiting for its timeout.
+	stopped := make(chan struct{})
+	go func() {
+		l.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected stop to return")
+	}
+	l.stop()
+}
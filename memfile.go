@@ -0,0 +1,307 @@
+package kea
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often a lease file is checked for appended records or rotation by kea-lfc.
+const leaseFileTailInterval = time.Second
+
+// Kea lease state for a lease in use; declined and reclaimed leases are not published.
+const leaseStateDefault = 0
+
+// Kea memfile lease types (lease6 only); prefix delegations are not published.
+const leaseTypePD = 2
+
+// LeaseFile holds the leases read from a Kea memfile CSV lease file
+// (kea-leases4.csv or kea-leases6.csv) and the .2/.1/.completed files
+// left beside it by kea-lfc. Only the newest record for each address is kept,
+// as Kea itself does when it loads the files.
+type LeaseFile struct {
+	Path string
+
+	mu     sync.RWMutex
+	leases map[string]Lease
+	header map[string]int
+	info   os.FileInfo
+	offset int64
+
+	loop loop
+}
+
+// Lease is a single lease record read from Kea's lease storage.
+type Lease struct {
+	IPAddress string
+	HwAddress string
+	ClientID  string // client_id for DHCPv4, duid for DHCPv6
+	ValidLft  int64
+	Expire    int64
+	SubnetID  int
+	Hostname  string
+	State     int
+	LeaseType int
+}
+
+// Cltt returns the client last transmission time of the lease.
+func (l Lease) Cltt() int64 { return l.Expire - l.ValidLft }
+
+// Active reports whether the lease should be published at the given time.
+func (l Lease) Active(now time.Time) bool {
+	// A record with a zero lifetime is how memfile marks a deleted lease.
+	return l.ValidLft != 0 && l.State == leaseStateDefault &&
+		l.LeaseType != leaseTypePD && l.Expire > now.Unix()
+}
+
+func NewLeaseFile(path string) *LeaseFile {
+	return &LeaseFile{Path: path, leases: map[string]Lease{}}
+}
+
+// Load (re)reads the lease file along with any files produced by kea-lfc,
+// in the order Kea loads them on startup.
+func (f *LeaseFile) Load() error {
+	leases := map[string]Lease{}
+
+	var files []string
+	if _, err := os.Stat(f.Path + ".completed"); err == nil {
+		files = []string{f.Path + ".completed"}
+	} else {
+		files = []string{f.Path + ".2", f.Path + ".1"}
+	}
+
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		header := map[string]int{}
+		if _, err := parseLeaseCSV(data, header, leases); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	header := map[string]int{}
+	consumed, err := parseLeaseCSV(data, header, leases)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.leases = leases
+	f.header = header
+	f.info = info
+	f.offset = int64(consumed)
+	f.mu.Unlock()
+
+	return nil
+}
+
+// poll reads records appended since the last read, reloading everything when
+// the file has been replaced or truncated by kea-lfc.
+func (f *LeaseFile) poll() error {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return err
+	}
+
+	f.mu.RLock()
+	replaced := f.info == nil || !os.SameFile(f.info, info) || info.Size() < f.offset
+	grown := info.Size() > f.offset
+	offset := f.offset
+	f.mu.RUnlock()
+
+	if replaced {
+		return f.Load()
+	}
+	if !grown {
+		return nil
+	}
+
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.NewSectionReader(file, offset, info.Size()-offset))
+	if err != nil {
+		return err
+	}
+
+	// Parse into copies, so a failure leaves the leases already read as they
+	// were.
+	f.mu.RLock()
+	header := maps.Clone(f.header)
+	leases := maps.Clone(f.leases)
+	f.mu.RUnlock()
+	consumed, err := parseLeaseCSV(data, header, leases)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.header = header
+	f.leases = leases
+	f.offset += int64(consumed)
+	f.info = info
+	f.mu.Unlock()
+
+	return nil
+}
+
+// Start begins tailing the lease file in the background.
+func (f *LeaseFile) Start() {
+	f.loop.start(leaseFileTailInterval, leaseFileTailInterval, false, func(context.Context) {
+		if err := f.poll(); err != nil {
+			log.Warningf("Failed to read lease file %s: %v", f.Path, err)
+		}
+	})
+}
+
+// Stop ends tailing started by Start.
+func (f *LeaseFile) Stop() {
+	f.loop.stop()
+}
+
+// Leases returns the active leases currently known.
+func (f *LeaseFile) Leases() (leases []Lease) {
+	now := time.Now()
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, lease := range f.leases {
+		if lease.Active(now) {
+			leases = append(leases, lease)
+		}
+	}
+	return
+}
+
+// HostnameMatches compares hostnames the way Kea does, ignoring case
+// and a trailing dot.
+func HostnameMatches(a string, b string) bool {
+	return strings.EqualFold(strings.TrimSuffix(a, "."), strings.TrimSuffix(b, "."))
+}
+
+// parseLeaseCSV applies every complete line in data to leases, reading the
+// column layout from a header line if one is present. It returns the number
+// of bytes consumed, which excludes a trailing partial line. It fails on a
+// line longer than the scanner's buffer, leaving leases partly updated.
+func parseLeaseCSV(data []byte, header map[string]int, leases map[string]Lease) (consumed int, err error) {
+	end := bytes.LastIndexByte(data, '\n')
+	if end < 0 {
+		return 0, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data[:end+1]))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if fields[0] == "address" {
+			clear(header)
+			for i, name := range fields {
+				header[name] = i
+			}
+			continue
+		}
+		if len(header) == 0 {
+			continue
+		}
+		lease, ok := parseLeaseRecord(fields, header)
+		if ok {
+			leases[lease.IPAddress] = lease
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return end + 1, nil
+}
+
+func parseLeaseRecord(fields []string, header map[string]int) (lease Lease, ok bool) {
+	column := func(name string) string {
+		i, found := header[name]
+		if !found || i >= len(fields) {
+			return ""
+		}
+		return unescapeLeaseField(fields[i])
+	}
+	number := func(name string) int64 {
+		n, _ := strconv.ParseInt(column(name), 10, 64)
+		return n
+	}
+
+	ip := net.ParseIP(column("address"))
+	if ip == nil {
+		return lease, false
+	}
+
+	lease = Lease{
+		IPAddress: ip.String(),
+		HwAddress: column("hwaddr"),
+		ClientID:  column("client_id"),
+		ValidLft:  number("valid_lifetime"),
+		Expire:    number("expire"),
+		SubnetID:  int(number("subnet_id")),
+		Hostname:  column("hostname"),
+		State:     int(number("state")),
+		LeaseType: int(number("lease_type")),
+	}
+	if duid := column("duid"); duid != "" {
+		lease.ClientID = duid
+	}
+
+	return lease, true
+}
+
+// unescapeLeaseField reverses Kea's CSV escaping, which writes commas and
+// other special characters as &#xNN.
+func unescapeLeaseField(field string) string {
+	if !strings.Contains(field, "&#x") {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if strings.HasPrefix(field[i:], "&#x") && i+5 <= len(field) {
+			if c, err := strconv.ParseUint(field[i+3:i+5], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 4
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,244 @@
+package kea
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testLeases4Header = "address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,user_context,pool_id\n"
+
+func writeLeaseFile(t *testing.T, path string, content string) {
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appendLeaseFile(t *testing.T, path string, content string) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func ipStrings(t *testing.T, leaseFile *LeaseFile, hostname string) (ips []string) {
+	records, err := LeaseFileSource{SourceLease4File, leaseFile}.LookupName(context.Background(), hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		ips = append(ips, record.IP.String())
+	}
+	return
+}
+
+func TestLeaseFileNewestRecordWins(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kea-leases4.csv")
+	writeLeaseFile(t, path, testLeases4Header+
+		"10.0.0.5,00:11:22:33:44:55,,3600,4102444800,1,0,0,old-name,0,,0\n"+
+		"10.0.0.5,00:11:22:33:44:55,,3600,4102444800,1,0,0,new-name,0,,0\n"+
+		"10.0.0.6,00:11:22:33:44:56,,3600,4102444800,1,0,0,deleted,0,,0\n"+
+		"10.0.0.6,00:11:22:33:44:56,,0,4102444800,1,0,0,deleted,0,,0\n"+
+		"10.0.0.7,00:11:22:33:44:57,,3600,1000,1,0,0,expired,0,,0\n"+
+		"10.0.0.8,00:11:22:33:44:58,,3600,4102444800,1,0,0,declined,1,,0\n"+
+		"10.0.0.9,00:11:22:33:44:59,,3600,4102444800,1,0,0,comma&#x2cname,0,,0\n")
+
+	leaseFile := NewLeaseFile(path)
+	if err := leaseFile.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		hostname string
+		expected int
+	}{
+		{"old-name", 0},
+		{"new-name", 1},
+		{"NEW-NAME.", 1},
+		{"deleted", 0},
+		{"expired", 0},
+		{"declined", 0},
+		{"comma,name", 1},
+	}
+	for _, test := range tests {
+		if ips := ipStrings(t, leaseFile, test.hostname); len(ips) != test.expected {
+			t.Errorf("%s: expected %d results, got %v", test.hostname, test.expected, ips)
+		}
+	}
+}
+
+func TestLeaseFileLFCFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "kea-leases4.csv")
+
+	writeLeaseFile(t, path+".2", testLeases4Header+
+		"10.0.0.5,00:11:22:33:44:55,,3600,4102444800,1,0,0,host-a,0,,0\n"+
+		"10.0.0.6,00:11:22:33:44:56,,3600,4102444800,1,0,0,host-b,0,,0\n")
+	writeLeaseFile(t, path+".1", testLeases4Header+
+		"10.0.0.6,00:11:22:33:44:56,,3600,4102444800,1,0,0,host-c,0,,0\n")
+	writeLeaseFile(t, path, testLeases4Header)
+
+	leaseFile := NewLeaseFile(path)
+	if err := leaseFile.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if ips := ipStrings(t, leaseFile, "host-a"); len(ips) != 1 || ips[0] != "10.0.0.5" {
+		t.Errorf("expected host-a from .2 file, got %v", ips)
+	}
+	if ips := ipStrings(t, leaseFile, "host-b"); len(ips) != 0 {
+		t.Errorf("expected host-b to be replaced by the .1 file, got %v", ips)
+	}
+
+	// Once kea-lfc has finished, the .completed file replaces .2 and .1.
+	writeLeaseFile(t, path+".completed", testLeases4Header+
+		"10.0.0.7,00:11:22:33:44:57,,3600,4102444800,1,0,0,host-d,0,,0\n")
+	if err := leaseFile.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if ips := ipStrings(t, leaseFile, "host-a"); len(ips) != 0 {
+		t.Errorf("expected .2 file to be ignored, got %v", ips)
+	}
+	if ips := ipStrings(t, leaseFile, "host-d"); len(ips) != 1 {
+		t.Errorf("expected host-d from .completed file, got %v", ips)
+	}
+}
+
+func TestLeaseFileTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kea-leases4.csv")
+	writeLeaseFile(t, path, testLeases4Header+
+		"10.0.0.5,00:11:22:33:44:55,,3600,4102444800,1,0,0,host-a,0,,0\n")
+
+	leaseFile := NewLeaseFile(path)
+	if err := leaseFile.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A partially written record is left until the rest of the line arrives.
+	appendLeaseFile(t, path, "10.0.0.6,00:11:22:33:44:56,,3600,41024")
+	if err := leaseFile.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if ips := ipStrings(t, leaseFile, "host-b"); len(ips) != 0 {
+		t.Errorf("expected partial record to be skipped, got %v", ips)
+	}
+
+	appendLeaseFile(t, path, "44800,1,0,0,host-b,0,,0\n")
+	if err := leaseFile.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if ips := ipStrings(t, leaseFile, "host-b"); len(ips) != 1 || ips[0] != "10.0.0.6" {
+		t.Errorf("expected appended record, got %v", ips)
+	}
+
+	// kea-lfc replaces the file with a fresh one.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	writeLeaseFile(t, path, testLeases4Header+
+		"10.0.0.7,00:11:22:33:44:57,,3600,4102444800,1,0,0,host-c,0,,0\n")
+	if err := leaseFile.poll(); err != nil {
+		t.Fatal(err)
+	}
+	for _, hostname := range []string{"host-a", "host-b", "host-c"} {
+		if ips := ipStrings(t, leaseFile, hostname); len(ips) != 1 {
+			t.Errorf("%s: expected a result after rotation, got %v", hostname, ips)
+		}
+	}
+}
+
+func TestLeaseFileLineTooLong(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kea-leases4.csv")
+	writeLeaseFile(t, path, testLeases4Header+
+		"10.0.0.5,00:11:22:33:44:55,,3600,4102444800,1,0,0,host-a,0,,0\n")
+
+	leaseFile := NewLeaseFile(path)
+	if err := leaseFile.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A line the scanner can't hold fails the read, and the leases read
+	// before it are kept as they were.
+	appendLeaseFile(t, path, "10.0.0.6,00:11:22:33:44:56,,3600,4102444800,1,0,0,host-b,0,,0\n"+
+		"10.0.0.7,00:11:22:33:44:57,,3600,4102444800,1,0,0,host-c,0,"+strings.Repeat("x", 2*1024*1024)+",0\n")
+	if err := leaseFile.poll(); err == nil {
+		t.Fatal("expected the overlong line to fail the read")
+	}
+	if ips := ipStrings(t, leaseFile, "host-a"); len(ips) != 1 {
+		t.Errorf("expected the previous leases to be kept, got %v", ips)
+	}
+	if ips := ipStrings(t, leaseFile, "host-b"); len(ips) != 0 {
+		t.Errorf("expected no lease from a partly read update, got %v", ips)
+	}
+}
+
+func TestLeaseFileIPv6(t *testing.T) {
+	leaseFile := NewLeaseFile("./resources/kea-leases6.csv")
+	if err := leaseFile.Load(); err != nil {
+		t.Fatal(err)
+	}
+	leases := leaseFile.Leases()
+	if len(leases) != 1 {
+		t.Fatalf("expected 1 lease, got %d", len(leases))
+	}
+	if leases[0].ClientID != "00:03:00:01:00:11:22:33:44:66" || leases[0].HwAddress != "00:11:22:33:44:66" {
+		t.Errorf("unexpected identifiers %+v", leases[0])
+	}
+	if ips := ipStrings(t, leaseFile, "laptop"); len(ips) != 1 || ips[0] != "2001:db8:1::20" {
+		t.Errorf("expected laptop lease, got %v", ips)
+	}
+}
+
+func TestGetIPsForLeaseFiles(t *testing.T) {
+	kea := Kea{
+		Lease4File: NewLeaseFile("./resources/kea-leases4.csv"),
+		Lease6File: NewLeaseFile("./resources/kea-leases6.csv"),
+		Networks:   []string{"10.0.0.0/16"},
+	}
+	for _, leaseFile := range []*LeaseFile{kea.Lease4File, kea.Lease6File} {
+		if err := leaseFile.Load(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, err := kea.GetIPsForHostname("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info) != 1 || info[0].String() != "10.0.0.20" {
+		t.Errorf("expected only the IPv4 lease inside networks, got %v", info)
+	}
+}
+
+func FuzzParseLeaseCSV(f *testing.F) {
+	for _, path := range []string{"./resources/kea-leases4.csv", "./resources/kea-leases6.csv"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte("address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state\n10.0.0.20,aa:bb:cc:dd:ee:01,,3600,1700003600,1,0,0,laptop&#x2cwork,0\n10.0.0.21,partial"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		leases := map[string]Lease{}
+		consumed, err := parseLeaseCSV(data, map[string]int{}, leases)
+		if err != nil {
+			return
+		}
+		if consumed < 0 || consumed > len(data) || (consumed > 0 && data[consumed-1] != '\n') {
+			t.Errorf("consumed %d bytes, which doesn't end a line", consumed)
+		}
+		for address, lease := range leases {
+			if net.ParseIP(address) == nil || address != lease.IPAddress {
+				t.Errorf("lease stored under invalid address %q", address)
+			}
+		}
+	})
+}
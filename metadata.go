@@ -0,0 +1,84 @@
+package kea
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/request"
+)
+
+// answeredRecord carries the record a query was answered with from ServeDNS
+// to the metadata functions, which are called later, for example by log.
+type answeredRecord struct {
+	record atomic.Pointer[Record]
+}
+
+type answeredRecordKey struct{}
+
+// setAnswered records the first record a query was answered with, when the
+// metadata plugin is enabled.
+func setAnswered(ctx context.Context, record Record) {
+	if answered, ok := ctx.Value(answeredRecordKey{}).(*answeredRecord); ok {
+		answered.record.Store(&record)
+	}
+}
+
+// Metadata implements the metadata.Provider interface. The kea/* values
+// describe the record a query was answered with, and are empty when this
+// plugin didn't answer it; kea/client-* describe the querying client's own
+// lease, which is only looked up when one of them is used.
+func (k Kea) Metadata(ctx context.Context, state request.Request) context.Context {
+	answered := &answeredRecord{}
+	ctx = context.WithValue(ctx, answeredRecordKey{}, answered)
+	answer := func(value func(Record) string) metadata.Func {
+		return func() string {
+			record := answered.record.Load()
+			if record == nil {
+				return ""
+			}
+			return value(*record)
+		}
+	}
+	metadata.SetValueFunc(ctx, "kea/hostname", answer(func(r Record) string { return r.Hostname }))
+	metadata.SetValueFunc(ctx, "kea/hw-address", answer(func(r Record) string { return r.HwAddress }))
+	metadata.SetValueFunc(ctx, "kea/subnet-id", answer(recordSubnetID))
+	metadata.SetValueFunc(ctx, "kea/source", answer(func(r Record) string { return r.Kind }))
+	metadata.SetValueFunc(ctx, "kea/lease-expiry", answer(recordExpiry))
+	metadata.SetValueFunc(ctx, "kea/correlated", answer(func(r Record) string { return r.CorrelatedBy }))
+
+	clientIP := net.ParseIP(state.IP())
+	client := sync.OnceValue(func() (client Record) {
+		if clientIP == nil {
+			return
+		}
+		// The query may be over by the time the value is used.
+		records, err := k.LookupAddr(context.Background(), clientIP)
+		if err != nil || len(records) == 0 {
+			return
+		}
+		return records[0]
+	})
+	metadata.SetValueFunc(ctx, "kea/client-hostname", func() string { return client().Hostname })
+	metadata.SetValueFunc(ctx, "kea/client-mac", func() string { return client().HwAddress })
+	return ctx
+}
+
+func recordSubnetID(record Record) string {
+	if record.SubnetID == 0 {
+		return ""
+	}
+	return strconv.Itoa(record.SubnetID)
+}
+
+// recordExpiry returns when a lease expires, in RFC 3339 format.
+func recordExpiry(record Record) string {
+	if record.Kind != RecordKindLease || record.ValidLft == 0 {
+		return ""
+	}
+	return time.Unix(record.Cltt+record.ValidLft, 0).UTC().Format(time.RFC3339)
+}
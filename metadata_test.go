@@ -0,0 +1,71 @@
+package kea
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestMetadata(t *testing.T) {
+	kea, _ := MakeTestKeaControlAgent(t)
+	kea.ExtractHostname = "true"
+	kea.Next = fallthroughHandler()
+
+	tests := []struct {
+		qname    string
+		qtype    uint16
+		remoteIP string
+		expected map[string]string
+	}{
+		{"laptop.example.org.", dns.TypeA, "10.0.0.21", map[string]string{
+			"kea/hostname":        "laptop",
+			"kea/hw-address":      "00:11:22:33:44:66",
+			"kea/subnet-id":       "1",
+			"kea/source":          RecordKindLease,
+			"kea/lease-expiry":    "2023-11-14T23:13:20Z",
+			"kea/client-hostname": "printer",
+			"kea/client-mac":      "00:11:22:33:44:77",
+		}},
+		{"nas.example.org.", dns.TypeA, "10.240.0.1", map[string]string{
+			"kea/hostname":        "nas",
+			"kea/source":          RecordKindReservation,
+			"kea/lease-expiry":    "",
+			"kea/client-hostname": "",
+		}},
+		// Values are empty when the query falls through.
+		{"unknown.example.org.", dns.TypeA, "10.0.0.20", map[string]string{
+			"kea/hostname":        "",
+			"kea/source":          "",
+			"kea/client-hostname": "laptop",
+		}},
+	}
+
+	for _, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, tc.qtype)
+		w := &test.ResponseWriter{RemoteIP: tc.remoteIP}
+
+		ctx := metadata.ContextWithMetadata(context.Background())
+		ctx = kea.Metadata(ctx, request.Request{W: w, Req: m})
+		if _, err := kea.ServeDNS(ctx, dnstest.NewRecorder(w), m); err != nil {
+			t.Fatal(err)
+		}
+
+		for label, expected := range tc.expected {
+			value := metadata.ValueFunc(ctx, label)
+			if value == nil {
+				t.Errorf("%s: %s isn't set", tc.qname, label)
+				continue
+			}
+			if actual := value(); actual != expected {
+				t.Errorf("%s: expected %s to be %q, got %q", tc.qname, label, expected, actual)
+			}
+		}
+	}
+}
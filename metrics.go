@@ -1,8 +1,6 @@
 package kea
 
 import (
-	"sync"
-
 	"github.com/coredns/coredns/plugin"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -16,4 +14,144 @@ var requestCount = promauto.NewCounterVec(prometheus.CounterOpts{
 	Help:      "Counter of requests made.",
 }, []string{"server"})
 
-var once sync.Once
+// Outcomes of a query, as counted by queryOutcomes.
+const (
+	// OutcomeAnswered is a query answered with addresses.
+	OutcomeAnswered = "answered"
+	// OutcomeNoData is a query for a known name which has no address of the
+	// query type; it is passed to the next plugin.
+	OutcomeNoData = "nodata"
+	// OutcomeFallthrough is a query for an unknown name or an unsupported
+	// type, passed to the next plugin.
+	OutcomeFallthrough = "fallthrough"
+	// OutcomeError is a query every source failed to look up; it is passed
+	// to the next plugin.
+	OutcomeError = "error"
+)
+
+var queryOutcomes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "kea",
+	Name:      "query_outcomes_total",
+	Help:      "Counter of queries by type and outcome.",
+}, []string{"server", "qtype", "outcome"})
+
+var apiRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "kea",
+	Name:      "api_request_duration_seconds",
+	Buckets:   plugin.TimeBuckets,
+	Help:      "Histogram of the time each Kea API request took, by command and endpoint.",
+}, []string{"server", "command", "endpoint"})
+
+var apiResults = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "kea",
+	Name:      "api_results_total",
+	Help:      "Counter of the result codes of Kea API replies, by command.",
+}, []string{"server", "command", "result"})
+
+var sourceErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "kea",
+	Name:      "source_errors_total",
+	Help:      "Counter of failed lookups by source and backend.",
+}, []string{"source", "backend"})
+
+var hostnameConflicts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "kea",
+	Name:      "hostname_conflicts_total",
+	Help:      "Counter of hostname conflicts seen, at most once an hour per hostname and family: addresses of one family held by several clients.",
+}, []string{"server", "family"})
+
+var endpointHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "kea",
+	Name:      "endpoint_healthy",
+	Help:      "Whether a backend answered its last health check (1) or not (0).",
+}, []string{"endpoint"})
+
+var requestsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "kea",
+	Name:      "requests_rejected_total",
+	Help:      "Counter of Kea requests rejected by the concurrency or rate limit.",
+}, []string{"backend", "reason"})
+
+var requestsShortCircuited = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "kea",
+	Name:      "requests_short_circuited_total",
+	Help:      "Counter of Kea requests not sent because the circuit breaker was open.",
+}, []string{"backend"})
+
+var circuitOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "kea",
+	Name:      "circuit_open",
+	Help:      "Whether the circuit breaker for a Kea backend is open (1) or closed (0).",
+}, []string{"backend"})
+
+var subnetAssignedAddresses = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "kea",
+	Name:      "subnet_assigned_addresses",
+	Help:      "Addresses Kea has leased in a subnet (assigned-addresses, or assigned-nas for DHCPv6).",
+}, []string{"backend", "service", "subnet_id"})
+
+var subnetTotalAddresses = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "kea",
+	Name:      "subnet_total_addresses",
+	Help:      "Addresses in a subnet's pools (total-addresses, or total-nas for DHCPv6).",
+}, []string{"backend", "service", "subnet_id"})
+
+var subnetDeclinedAddresses = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "kea",
+	Name:      "subnet_declined_addresses",
+	Help:      "Addresses in a subnet clients have declined (declined-addresses).",
+}, []string{"backend", "service", "subnet_id"})
+
+var packets = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "kea",
+	Name:      "packets",
+	Help:      "Kea's pkt4-* and pkt6-* packet counters, by the rest of the statistic's name.",
+}, []string{"backend", "service", "type"})
+
+var inventoryHostnames = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "kea",
+	Name:      "inventory_hostnames",
+	Help:      "Distinct hostnames published from the sources which can be listed.",
+}, []string{"server"})
+
+var inventoryAddresses = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "kea",
+	Name:      "inventory_addresses",
+	Help:      "Distinct addresses published from the sources which can be listed, by family.",
+}, []string{"server", "family"})
+
+var inventoryRecords = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "kea",
+	Name:      "inventory_records",
+	Help:      "Records published from the sources which can be listed, by kind.",
+}, []string{"server", "kind"})
+
+var inventoryFilteredHostnames = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "kea",
+	Name:      "inventory_filtered_hostnames",
+	Help:      "Hostnames not published because every address is outside of networks.",
+}, []string{"server"})
+
+var inventoryConflictingHostnames = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "kea",
+	Name:      "inventory_conflicting_hostnames",
+	Help:      "Published hostnames with addresses of one family held by several clients.",
+}, []string{"server"})
@@ -0,0 +1,84 @@
+package kea
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/ionothanus/coredns-kea/keatest"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestServeDNSMetrics(t *testing.T) {
+	kea, server := MakeTestKeaControlAgent(t)
+	kea.ExtractHostname = "true"
+	kea.Next = fallthroughHandler()
+	ctx := context.WithValue(context.Background(), dnsserver.Key{}, &dnsserver.Server{Addr: "dns://:5353"})
+
+	queries := []struct {
+		qname string
+		qtype uint16
+		fault *keatest.Fault
+	}{
+		{"laptop.example.org.", dns.TypeA, nil},
+		{"laptop.example.org.", dns.TypeAAAA, nil},
+		{"laptop.example.org.", dns.TypeMX, nil},
+		{"unknown.example.org.", dns.TypeA, nil},
+		{"printer.example.org.", dns.TypeAAAA, nil},
+		{"laptop.example.org.", dns.TypeA, &keatest.Fault{HTTPStatus: 500}},
+	}
+	for _, q := range queries {
+		server.Reset()
+		if q.fault != nil {
+			server.Inject(*q.fault)
+		}
+		m := new(dns.Msg)
+		m.SetQuestion(q.qname, q.qtype)
+		kea.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter{}), m)
+	}
+
+	if count := testutil.ToFloat64(requestCount.WithLabelValues("dns://:5353")); count != float64(len(queries)) {
+		t.Errorf("expected %d requests, got %v", len(queries), count)
+	}
+	outcomes := []struct {
+		qtype   string
+		outcome string
+		count   float64
+	}{
+		{"A", OutcomeAnswered, 1},
+		{"AAAA", OutcomeAnswered, 1},
+		{"MX", OutcomeFallthrough, 1},
+		{"A", OutcomeFallthrough, 1},
+		{"AAAA", OutcomeNoData, 1},
+		{"A", OutcomeError, 1},
+	}
+	for _, o := range outcomes {
+		if count := testutil.ToFloat64(queryOutcomes.WithLabelValues("dns://:5353", o.qtype, o.outcome)); count != o.count {
+			t.Errorf("expected %v %s %s queries, got %v", o.count, o.qtype, o.outcome, count)
+		}
+	}
+
+	// Both families are looked up for the four A and AAAA queries Kea
+	// answered: laptop twice, printer, and unknown, which has no lease.
+	if count := testutil.ToFloat64(apiResults.WithLabelValues("dns://:5353", "lease4-get-by-hostname", "success")); count != 3 {
+		t.Errorf("expected 3 successful lease4-get-by-hostname, got %v", count)
+	}
+	if count := testutil.ToFloat64(apiResults.WithLabelValues("dns://:5353", "lease4-get-by-hostname", "empty")); count != 1 {
+		t.Errorf("expected 1 empty lease4-get-by-hostname, got %v", count)
+	}
+
+	var metric dto.Metric
+	observer := apiRequestDuration.WithLabelValues("dns://:5353", "lease4-get-by-hostname", server.URL)
+	if err := observer.(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	if samples := metric.GetHistogram().GetSampleCount(); samples == 0 {
+		t.Error("expected Kea request durations to be observed")
+	}
+}
@@ -2,4 +2,20 @@ package kea
 
 // Ready implements the ready.Readiness interface, once this flips to true CoreDNS
 // assumes this plugin is ready for queries; it is not checked again.
-func (e Kea) Ready() bool { return true }
+// Configuration and lease files are loaded during setup, so this waits for
+// one of the Kea endpoints of each backend and the lease database, if
+// configured, to answer a health check.
+func (e Kea) Ready() bool {
+	if e.Endpoints != nil && !e.Endpoints.Reached() {
+		return false
+	}
+	for _, backend := range e.Backends {
+		if !backend.Endpoints.Reached() {
+			return false
+		}
+	}
+	if e.LeaseDB != nil && !e.LeaseDB.Reached() {
+		return false
+	}
+	return true
+}
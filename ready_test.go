@@ -0,0 +1,45 @@
+package kea
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReadyWaitsForEndpoint(t *testing.T) {
+	server := newLimitedControlAgent(t)
+
+	endpoint := NewEndpoint(server.URL, false, []string{KEA_IPV4_SERVICE_NAME, KEA_IPV6_SERVICE_NAME})
+	kea := Kea{Endpoints: &EndpointPool{Endpoints: []*Endpoint{endpoint}}}
+	if kea.Ready() {
+		t.Fatal("expected not to be ready before the endpoint is reached")
+	}
+
+	endpoint.check(context.Background())
+	if !kea.Ready() || !endpoint.Healthy() {
+		t.Fatal("expected to be ready once the endpoint answers status-get")
+	}
+	if gauge := testutil.ToFloat64(endpointHealthy.WithLabelValues(server.URL)); gauge != 1 {
+		t.Errorf("expected the health gauge to be 1, got %v", gauge)
+	}
+
+	server.Close()
+	endpoint.check(context.Background())
+	if endpoint.Healthy() {
+		t.Error("expected the endpoint to be unhealthy once it stops answering")
+	}
+	if !kea.Ready() {
+		t.Error("expected readiness to stay true once reached")
+	}
+	if gauge := testutil.ToFloat64(endpointHealthy.WithLabelValues(server.URL)); gauge != 0 {
+		t.Errorf("expected the health gauge to be 0, got %v", gauge)
+	}
+}
+
+func TestReadyWithConfFiles(t *testing.T) {
+	kea := MakeTestKeaConfFiles()
+	if !kea.Ready() {
+		t.Error("expected to be ready once configuration files are loaded")
+	}
+}
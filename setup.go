@@ -2,39 +2,94 @@ package kea
 
 import (
 	"encoding/json"
+	"math"
+	"net"
 	"os"
+	"slices"
+	"strconv"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 )
 
+// How long a query waits for every source to answer, unless lookup_timeout is set.
+const defaultLookupTimeout = 2 * time.Second
+
 // init registers this plugin.
 func init() { plugin.Register("kea", setup) }
 
 func setup(c *caddy.Controller) error {
 
-	controlAgent := ""
+	controlAgents := []string{}
+	backends := map[string][]string{}
+	backendNames := []string{}
 	dhcp4_conf := ""
 	dhcp6_conf := ""
+	lease4_file := ""
+	lease6_file := ""
+	leaseDBType := ""
+	leaseDBSource := ""
 	networks := []string{}
+	txtClients := []string{}
+	syntheticNames := []SyntheticName{}
+	identifierNames := []IdentifierName{}
+	whoami := ""
+	correlateFamilies := "false"
+	conflictPolicy := ConflictPolicyAll
 	insecure := "false"
+	haHeartbeat := "false"
+	statistics := "false"
+	statisticsInterval := defaultStatisticsInterval
 	extractHostname := "false"
 	controlAgentLeases := ""
 	controlAgentReservations := "true"
 	useIPv4 := "true"
 	useIPv6 := "true"
+	sourceNames := []string{}
+	lookupTimeout := defaultLookupTimeout
+	limits := DefaultRequestLimits()
 
 	c.Next()
 	if c.NextBlock() {
 		for {
 			switch c.Val() {
 			case "control_agent":
-				if !c.NextArg() {
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return plugin.Error("kea", c.ArgErr())
+				}
+				controlAgents = append(controlAgents, args...)
+				controlAgentLeases = "true"
+			case "backend":
+				args := c.RemainingArgs()
+				if len(args) < 2 {
 					return plugin.Error("kea", c.ArgErr())
 				}
-				controlAgent = c.Val()
+				if _, ok := backends[args[0]]; ok {
+					return plugin.Error("kea", c.Errf("backend %q is defined more than once", args[0]))
+				}
+				backendNames = append(backendNames, args[0])
+				backends[args[0]] = args[1:]
 				controlAgentLeases = "true"
+			case "ha_heartbeat":
+				if !c.NextArg() {
+					return plugin.Error("kea", c.ArgErr())
+				}
+				haHeartbeat = c.Val()
+			case "statistics":
+				if !c.NextArg() {
+					return plugin.Error("kea", c.ArgErr())
+				}
+				statistics = c.Val()
+				if c.NextArg() {
+					interval, err := time.ParseDuration(c.Val())
+					if err != nil || interval <= 0 {
+						return plugin.Error("kea", c.Errf("invalid statistics interval %q", c.Val()))
+					}
+					statisticsInterval = interval
+				}
 			case "dhcp4_conf":
 				if !c.NextArg() {
 					return plugin.Error("kea", c.ArgErr())
@@ -47,6 +102,85 @@ func setup(c *caddy.Controller) error {
 				}
 				dhcp6_conf = c.Val()
 				useIPv6 = "true"
+			case "lease4_file":
+				if !c.NextArg() {
+					return plugin.Error("kea", c.ArgErr())
+				}
+				lease4_file = c.Val()
+				useIPv4 = "true"
+			case "lease6_file":
+				if !c.NextArg() {
+					return plugin.Error("kea", c.ArgErr())
+				}
+				lease6_file = c.Val()
+				useIPv6 = "true"
+			case "lease_db":
+				if !c.NextArg() {
+					return plugin.Error("kea", c.ArgErr())
+				}
+				leaseDBType = c.Val()
+				if !c.NextArg() {
+					return plugin.Error("kea", c.ArgErr())
+				}
+				leaseDBSource = c.Val()
+			case "sources":
+				for c.NextArg() {
+					sourceNames = append(sourceNames, c.Val())
+				}
+				if len(sourceNames) == 0 {
+					return plugin.Error("kea", c.ArgErr())
+				}
+			case "lookup_timeout":
+				if !c.NextArg() {
+					return plugin.Error("kea", c.ArgErr())
+				}
+				timeout, err := time.ParseDuration(c.Val())
+				if err != nil || timeout <= 0 {
+					return plugin.Error("kea", c.Errf("invalid lookup_timeout %q", c.Val()))
+				}
+				lookupTimeout = timeout
+			case "max_concurrent_requests":
+				if !c.NextArg() {
+					return plugin.Error("kea", c.ArgErr())
+				}
+				maxConcurrent, err := strconv.Atoi(c.Val())
+				if err != nil || maxConcurrent < 0 {
+					return plugin.Error("kea", c.Errf("invalid max_concurrent_requests %q", c.Val()))
+				}
+				limits.MaxConcurrent = maxConcurrent
+			case "request_rate":
+				if !c.NextArg() {
+					return plugin.Error("kea", c.ArgErr())
+				}
+				rate, err := strconv.ParseFloat(c.Val(), 64)
+				if err != nil || rate < 0 {
+					return plugin.Error("kea", c.Errf("invalid request_rate %q", c.Val()))
+				}
+				limits.Rate = rate
+				limits.Burst = int(math.Ceil(rate))
+				if c.NextArg() {
+					burst, err := strconv.Atoi(c.Val())
+					if err != nil || burst < 1 {
+						return plugin.Error("kea", c.Errf("invalid request_rate burst %q", c.Val()))
+					}
+					limits.Burst = burst
+				}
+			case "circuit_breaker":
+				if !c.NextArg() {
+					return plugin.Error("kea", c.ArgErr())
+				}
+				failures, err := strconv.Atoi(c.Val())
+				if err != nil || failures < 0 {
+					return plugin.Error("kea", c.Errf("invalid circuit_breaker failures %q", c.Val()))
+				}
+				limits.BreakerFailures = failures
+				if c.NextArg() {
+					cooldown, err := time.ParseDuration(c.Val())
+					if err != nil || cooldown <= 0 {
+						return plugin.Error("kea", c.Errf("invalid circuit_breaker cooldown %q", c.Val()))
+					}
+					limits.BreakerCooldown = cooldown
+				}
 			case "networks":
 				for c.NextArg() {
 					networks = append(networks, c.Val())
@@ -54,6 +188,63 @@ func setup(c *caddy.Controller) error {
 				if len(networks) == 0 {
 					return plugin.Error("kea", c.ArgErr())
 				}
+			case "txt_records":
+				for c.NextArg() {
+					if _, _, err := net.ParseCIDR(c.Val()); err != nil {
+						return plugin.Error("kea", c.Errf("invalid txt_records network %q", c.Val()))
+					}
+					txtClients = append(txtClients, c.Val())
+				}
+				if len(txtClients) == 0 {
+					return plugin.Error("kea", c.ArgErr())
+				}
+			case "synthetic_names":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return plugin.Error("kea", c.ArgErr())
+				}
+				var suffix string
+				templateNetworks := args[1:]
+				if i := slices.Index(templateNetworks, "suffix"); i != -1 {
+					if i != len(templateNetworks)-2 {
+						return plugin.Error("kea", c.ArgErr())
+					}
+					suffix = templateNetworks[i+1]
+					templateNetworks = templateNetworks[:i]
+				}
+				synthetic, err := NewSyntheticName(args[0], suffix, templateNetworks)
+				if err != nil {
+					return plugin.Error("kea", c.Err(err.Error()))
+				}
+				syntheticNames = append(syntheticNames, synthetic)
+			case "identifier_names":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return plugin.Error("kea", c.ArgErr())
+				}
+				identifierType, ok := IdentifierNameTypes[args[0]]
+				if !ok {
+					return plugin.Error("kea", c.Errf("unknown identifier type %q", args[0]))
+				}
+				identifierNames = append(identifierNames, IdentifierName{Type: identifierType, Zone: args[1]})
+			case "whoami":
+				if !c.NextArg() {
+					return plugin.Error("kea", c.ArgErr())
+				}
+				whoami = c.Val()
+			case "correlate_families":
+				if !c.NextArg() {
+					return plugin.Error("kea", c.ArgErr())
+				}
+				correlateFamilies = c.Val()
+			case "conflict_policy":
+				if !c.NextArg() {
+					return plugin.Error("kea", c.ArgErr())
+				}
+				if !slices.Contains(ConflictPolicies, c.Val()) {
+					return plugin.Error("kea", c.Errf("unknown conflict_policy %q", c.Val()))
+				}
+				conflictPolicy = c.Val()
 			case "insecure":
 				if !c.NextArg() {
 					return plugin.Error("kea", c.ArgErr())
@@ -95,8 +286,8 @@ func setup(c *caddy.Controller) error {
 		}
 	}
 
-	if controlAgent == "" && dhcp4_conf == "" && dhcp6_conf == "" {
-		return plugin.Error("kea", c.Err("One of control_agent, dhcp4_conf or dhcp6_conf must be set"))
+	if len(controlAgents) == 0 && len(backends) == 0 && dhcp4_conf == "" && dhcp6_conf == "" && lease4_file == "" && lease6_file == "" && leaseDBType == "" {
+		return plugin.Error("kea", c.Err("One of control_agent, backend, dhcp4_conf, dhcp6_conf, lease4_file, lease6_file or lease_db must be set"))
 	}
 
 	if dhcp4_conf != "" && useIPv4 != "true" {
@@ -107,7 +298,23 @@ func setup(c *caddy.Controller) error {
 		return plugin.Error("kea", c.Err("dhcp6_conf requires use_ipv6 to be true"))
 	}
 
-	if controlAgent == "" && controlAgentLeases == "true" {
+	if lease4_file != "" && useIPv4 != "true" {
+		return plugin.Error("kea", c.Err("lease4_file requires use_ipv4 to be true"))
+	}
+
+	if lease6_file != "" && useIPv6 != "true" {
+		return plugin.Error("kea", c.Err("lease6_file requires use_ipv6 to be true"))
+	}
+
+	if len(controlAgents) == 0 && len(backends) == 0 && haHeartbeat == "true" {
+		return plugin.Error("kea", c.Err("ha_heartbeat is only valid when control_agent or backend is set"))
+	}
+
+	if len(controlAgents) == 0 && len(backends) == 0 && statistics == "true" {
+		return plugin.Error("kea", c.Err("statistics is only valid when control_agent or backend is set"))
+	}
+
+	if len(controlAgents) == 0 && len(backends) == 0 && controlAgentLeases == "true" {
 		return plugin.Error("kea", c.Err("use_leases is only valid when control_agent is set (conf files only provide reservations)"))
 	}
 
@@ -142,25 +349,170 @@ func setup(c *caddy.Controller) error {
 		}
 	}
 
+	lease4File, err := setupLeaseFile(c, lease4_file)
+	if err != nil {
+		return plugin.Error("kea", err)
+	}
+	lease6File, err := setupLeaseFile(c, lease6_file)
+	if err != nil {
+		return plugin.Error("kea", err)
+	}
+
+	var leaseDB *LeaseDB
+	if leaseDBType != "" {
+		leaseDB, err = OpenLeaseDB(leaseDBType, leaseDBSource)
+		if err != nil {
+			return plugin.Error("kea", c.Err(err.Error()))
+		}
+		c.OnStartup(func() error {
+			leaseDB.Start()
+			return nil
+		})
+		c.OnShutdown(func() error {
+			leaseDB.Stop()
+			return leaseDB.Close()
+		})
+	}
+
+	kea := Kea{
+		ControlAgents:            controlAgents,
+		Networks:                 networks,
+		Insecure:                 insecure,
+		ExtractHostname:          extractHostname,
+		ControlAgentLeases:       controlAgentLeases,
+		ControlAgentReservations: controlAgentReservations,
+		UseIPv4:                  useIPv4,
+		UseIPv6:                  useIPv6,
+		DHCP4ConfPath:            dhcp4_conf,
+		DHCP6ConfPath:            dhcp6_conf,
+		DHCP4Conf:                dhcp4Conf,
+		DHCP6Conf:                dhcp6Conf,
+		Lease4FilePath:           lease4_file,
+		Lease6FilePath:           lease6_file,
+		Lease4File:               lease4File,
+		Lease6File:               lease6File,
+		LeaseDB:                  leaseDB,
+		LookupTimeout:            lookupTimeout,
+		TXTClients:               txtClients,
+		SyntheticNames:           syntheticNames,
+		IdentifierNames:          identifierNames,
+		WhoAmI:                   whoami,
+		CorrelateFamilies:        correlateFamilies,
+		ConflictPolicy:           conflictPolicy,
+		Conflicts:                &ConflictLog{Server: serverLabel(dnsserver.GetConfig(c))},
+	}
+
+	if len(controlAgents) > 0 {
+		kea.Endpoints = NewEndpointPool(controlAgents, insecure == "true", kea.services(), haHeartbeat == "true")
+		kea.Endpoints.Guard = NewRequestGuard(limits, "")
+		setupEndpointPool(c, kea.Endpoints)
+		if statistics == "true" {
+			setupStatistics(c, NewStatisticsCollector("", kea.Endpoints, kea.services(), statisticsInterval))
+		}
+	}
+
+	for _, name := range backendNames {
+		backend := Backend{
+			Name:      name,
+			Endpoints: NewEndpointPool(backends[name], insecure == "true", kea.services(), haHeartbeat == "true"),
+		}
+		backend.Endpoints.Guard = NewRequestGuard(limits, name)
+		setupEndpointPool(c, backend.Endpoints)
+		if statistics == "true" {
+			setupStatistics(c, NewStatisticsCollector(name, backend.Endpoints, kea.services(), statisticsInterval))
+		}
+		kea.Backends = append(kea.Backends, backend)
+	}
+
+	kea.Sources = kea.ConfiguredSources()
+	if len(sourceNames) > 0 {
+		kea.Sources, err = OrderSources(kea.Sources, sourceNames)
+		if err != nil {
+			return plugin.Error("kea", c.Err(err.Error()))
+		}
+	}
+
+	if kea.hasListers() {
+		exporter := &InventoryExporter{
+			Kea:      kea,
+			Server:   kea.Conflicts.Server,
+			Interval: inventoryInterval,
+			Timeout:  inventoryTimeout,
+		}
+		c.OnStartup(func() error {
+			exporter.Start()
+			return nil
+		})
+		c.OnShutdown(func() error {
+			exporter.Stop()
+			return nil
+		})
+	}
+
 	// Add the Plugin to CoreDNS, so Servers can use it in their plugin chain.
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
-		return Kea{
-			ControlAgent:             controlAgent,
-			Networks:                 networks,
-			Insecure:                 insecure,
-			ExtractHostname:          extractHostname,
-			ControlAgentLeases:       controlAgentLeases,
-			ControlAgentReservations: controlAgentReservations,
-			Next:                     next,
-			UseIPv4:                  useIPv4,
-			UseIPv6:                  useIPv6,
-			DHCP4ConfPath:            dhcp4_conf,
-			DHCP6ConfPath:            dhcp6_conf,
-			DHCP4Conf:                dhcp4Conf,
-			DHCP6Conf:                dhcp6Conf,
-		}
+		kea.Next = next
+		return kea
 	})
 
 	// All OK, return a nil error.
 	return nil
 }
+
+// setupLeaseFile loads a memfile lease file and tails it while the server runs.
+func setupLeaseFile(c *caddy.Controller, path string) (*LeaseFile, error) {
+	if path == "" {
+		return nil, nil
+	}
+	leaseFile := NewLeaseFile(path)
+	if err := leaseFile.Load(); err != nil {
+		return nil, err
+	}
+	c.OnStartup(func() error {
+		leaseFile.Start()
+		return nil
+	})
+	c.OnShutdown(func() error {
+		leaseFile.Stop()
+		return nil
+	})
+	return leaseFile, nil
+}
+
+// setupEndpointPool runs an endpoint pool's health checks while the server runs.
+func setupEndpointPool(c *caddy.Controller, pool *EndpointPool) {
+	c.OnStartup(func() error {
+		pool.Start()
+		return nil
+	})
+	c.OnShutdown(func() error {
+		pool.Stop()
+		return nil
+	})
+}
+
+// setupStatistics exports a Kea server's statistics while the server runs.
+func setupStatistics(c *caddy.Controller, collector *StatisticsCollector) {
+	c.OnStartup(func() error {
+		collector.Start()
+		return nil
+	})
+	c.OnShutdown(func() error {
+		collector.Stop()
+		return nil
+	})
+}
+
+// serverLabel returns the server label the metrics plugin gives queries to a
+// server block, such as "dns://:53", from its first listen address.
+func serverLabel(config *dnsserver.Config) string {
+	host := ""
+	if len(config.ListenHosts) > 0 {
+		host = config.ListenHosts[0]
+	}
+	address := net.JoinHostPort(host, config.Port)
+	if tcpAddr, err := net.ResolveTCPAddr("tcp", address); err == nil {
+		address = tcpAddr.String()
+	}
+	return config.Transport + "://" + address
+}
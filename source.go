@@ -0,0 +1,430 @@
+package kea
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Names of the sources, as used by the sources directive.
+const (
+	SourceControlAgentLeases       = "control_agent_leases"
+	SourceControlAgentReservations = "control_agent_reservations"
+	SourceDHCP4Conf                = "dhcp4_conf"
+	SourceDHCP6Conf                = "dhcp6_conf"
+	SourceLease4File               = "lease4_file"
+	SourceLease6File               = "lease6_file"
+	SourceLeaseDB                  = "lease_db"
+)
+
+// SourceNames lists every source in the default lookup order.
+var SourceNames = []string{
+	SourceControlAgentLeases,
+	SourceControlAgentReservations,
+	SourceDHCP4Conf,
+	SourceDHCP6Conf,
+	SourceLease4File,
+	SourceLease6File,
+	SourceLeaseDB,
+}
+
+// Kinds of record a source can return.
+const (
+	RecordKindLease       = "lease"
+	RecordKindReservation = "reservation"
+	RecordKindConf        = "conf"
+)
+
+// Record is a single hostname/address binding found by a Source.
+type Record struct {
+	Hostname  string
+	IP        net.IP
+	HwAddress string
+	ClientID  string // client-id for DHCPv4, DUID for DHCPv6
+	SubnetID  int
+	Cltt      int64
+	ValidLft  int64
+	State     int
+	Kind      string
+	Source    string
+	Backend   string // the named Kea backend, for control agent records
+	// CorrelatedBy describes how a record of the other address family was
+	// associated with a hostname, when correlate_families found it.
+	CorrelatedBy string
+}
+
+// Source is a place Kea keeps hostname/address bindings.
+type Source interface {
+	Name() string
+	LookupName(ctx context.Context, name string) ([]Record, error)
+	LookupAddr(ctx context.Context, ip net.IP) ([]Record, error)
+}
+
+// Lister is implemented by sources which can return every record they hold.
+type Lister interface {
+	List(ctx context.Context) ([]Record, error)
+}
+
+// Types of client identifier records can be looked up by, as Kea names them.
+const (
+	IdentifierHwAddress = "hw-address"
+	IdentifierClientID  = "client-id"
+	IdentifierDUID      = "duid"
+)
+
+// IdentifierSource is implemented by sources which can look records up by
+// the client's hardware address, client-id or DUID.
+type IdentifierSource interface {
+	LookupIdentifier(ctx context.Context, identifierType string, identifier string) ([]Record, error)
+}
+
+// BackendSource is implemented by sources belonging to a named Kea backend.
+type BackendSource interface {
+	Backend() string
+}
+
+// sourceLabel names a source in logs, along with its backend if it has one.
+func sourceLabel(source Source) string {
+	if backend := sourceBackend(source); backend != "" {
+		return source.Name() + " (" + backend + ")"
+	}
+	return source.Name()
+}
+
+func sourceBackend(source Source) string {
+	if source, ok := source.(BackendSource); ok {
+		return source.Backend()
+	}
+	return ""
+}
+
+// OrderSources returns the sources named in names, in that order. Earlier
+// sources take precedence when two return the same address. A name matches
+// the source of that kind for every backend.
+func OrderSources(sources []Source, names []string) (ordered []Source, err error) {
+	for _, name := range names {
+		if !slices.Contains(SourceNames, name) {
+			return nil, fmt.Errorf("unknown source %q", name)
+		}
+		if slices.ContainsFunc(ordered, func(s Source) bool { return s.Name() == name }) {
+			return nil, fmt.Errorf("source %q is listed more than once", name)
+		}
+		found := false
+		for _, source := range sources {
+			if source.Name() == name {
+				ordered = append(ordered, source)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("source %q is not configured", name)
+		}
+	}
+	return ordered, nil
+}
+
+// DHCP4ConfSource returns reservations from a kea-dhcp4 configuration file.
+type DHCP4ConfSource struct {
+	Conf     KeaDHCP4Conf
+	Networks []string
+}
+
+func (s DHCP4ConfSource) Name() string { return SourceDHCP4Conf }
+
+func (s DHCP4ConfSource) List(ctx context.Context) (records []Record, err error) {
+	for _, subnet := range s.Conf.Dhcp4.Subnet4 {
+		if !subnetInNetworks(subnet.Subnet, s.Networks) {
+			continue
+		}
+		for _, reservation := range subnet.Reservations {
+			ip := net.ParseIP(reservation.IpAddress)
+			if ip == nil {
+				continue
+			}
+			records = append(records, Record{
+				Hostname:  reservation.Hostname,
+				IP:        ip,
+				HwAddress: reservation.HwAddress,
+				ClientID:  reservation.ClientID,
+				Kind:      RecordKindConf,
+				Source:    SourceDHCP4Conf,
+			})
+		}
+	}
+	return records, nil
+}
+
+func (s DHCP4ConfSource) LookupName(ctx context.Context, name string) ([]Record, error) {
+	return listByName(ctx, s, name)
+}
+
+func (s DHCP4ConfSource) LookupAddr(ctx context.Context, ip net.IP) ([]Record, error) {
+	return listByAddr(ctx, s, ip)
+}
+
+func (s DHCP4ConfSource) LookupIdentifier(ctx context.Context, identifierType string, identifier string) ([]Record, error) {
+	return listByIdentifier(ctx, s, identifierType, identifier)
+}
+
+// DHCP6ConfSource returns reservations from a kea-dhcp6 configuration file.
+type DHCP6ConfSource struct {
+	Conf     KeaDHCP6Conf
+	Networks []string
+}
+
+func (s DHCP6ConfSource) Name() string { return SourceDHCP6Conf }
+
+func (s DHCP6ConfSource) List(ctx context.Context) (records []Record, err error) {
+	for _, subnet := range s.Conf.Dhcp6.Subnet6 {
+		if !subnetInNetworks(subnet.Subnet, s.Networks) {
+			continue
+		}
+		for _, reservation := range subnet.Reservations {
+			for _, ipString := range reservation.IpAddresses {
+				ip := net.ParseIP(ipString)
+				if ip == nil {
+					continue
+				}
+				records = append(records, Record{
+					Hostname:  reservation.Hostname,
+					IP:        ip,
+					HwAddress: reservation.HwAddress,
+					ClientID:  reservation.DUID,
+					Kind:      RecordKindConf,
+					Source:    SourceDHCP6Conf,
+				})
+			}
+		}
+	}
+	return records, nil
+}
+
+func (s DHCP6ConfSource) LookupName(ctx context.Context, name string) ([]Record, error) {
+	return listByName(ctx, s, name)
+}
+
+func (s DHCP6ConfSource) LookupAddr(ctx context.Context, ip net.IP) ([]Record, error) {
+	return listByAddr(ctx, s, ip)
+}
+
+func (s DHCP6ConfSource) LookupIdentifier(ctx context.Context, identifierType string, identifier string) ([]Record, error) {
+	return listByIdentifier(ctx, s, identifierType, identifier)
+}
+
+// subnetInNetworks reports whether a configured subnet is one of networks;
+// conf file reservations are filtered by subnet rather than by address.
+func subnetInNetworks(subnet string, networks []string) bool {
+	return len(networks) == 0 || slices.IndexFunc(networks, func(n string) bool {
+		return CompareCIDRs(n, subnet)
+	}) != -1
+}
+
+// LeaseFileSource returns leases from a memfile lease file.
+type LeaseFileSource struct {
+	SourceName string
+	File       *LeaseFile
+}
+
+func (s LeaseFileSource) Name() string { return s.SourceName }
+
+func (s LeaseFileSource) List(ctx context.Context) (records []Record, err error) {
+	for _, lease := range s.File.Leases() {
+		records = append(records, lease.Record(s.SourceName))
+	}
+	return records, nil
+}
+
+func (s LeaseFileSource) LookupName(ctx context.Context, name string) ([]Record, error) {
+	return listByName(ctx, s, name)
+}
+
+func (s LeaseFileSource) LookupAddr(ctx context.Context, ip net.IP) ([]Record, error) {
+	return listByAddr(ctx, s, ip)
+}
+
+func (s LeaseFileSource) LookupIdentifier(ctx context.Context, identifierType string, identifier string) ([]Record, error) {
+	return listByIdentifier(ctx, s, identifierType, identifier)
+}
+
+// LeaseDBSource returns leases from a Kea SQL lease database.
+type LeaseDBSource struct {
+	DB      *LeaseDB
+	UseIPv4 bool
+	UseIPv6 bool
+}
+
+func (s LeaseDBSource) Name() string { return SourceLeaseDB }
+
+func (s LeaseDBSource) LookupName(ctx context.Context, name string) ([]Record, error) {
+	return lookupFamilies(s.UseIPv4, s.UseIPv6, func(family int) (records []Record, err error) {
+		leases, err := s.DB.GetLeasesForHostname(ctx, name, family)
+		if err != nil {
+			return nil, err
+		}
+		for _, lease := range leases {
+			records = append(records, lease.Record(SourceLeaseDB))
+		}
+		return records, nil
+	})
+}
+
+func (s LeaseDBSource) LookupAddr(ctx context.Context, ip net.IP) (records []Record, err error) {
+	leases, err := s.DB.GetLeasesForIP(ctx, ip)
+	if err != nil {
+		return nil, err
+	}
+	for _, lease := range leases {
+		records = append(records, lease.Record(SourceLeaseDB))
+	}
+	return records, nil
+}
+
+func (s LeaseDBSource) LookupIdentifier(ctx context.Context, identifierType string, identifier string) ([]Record, error) {
+	return lookupFamilies(s.UseIPv4, s.UseIPv6, func(family int) (records []Record, err error) {
+		leases, err := s.DB.GetLeasesForIdentifier(ctx, identifierType, identifier, family)
+		if err != nil {
+			return nil, err
+		}
+		for _, lease := range leases {
+			records = append(records, lease.Record(SourceLeaseDB))
+		}
+		return records, nil
+	})
+}
+
+func (l Lease) Record(source string) Record {
+	return Record{
+		Hostname:  l.Hostname,
+		IP:        net.ParseIP(l.IPAddress),
+		HwAddress: l.HwAddress,
+		ClientID:  l.ClientID,
+		SubnetID:  l.SubnetID,
+		Cltt:      l.Cltt(),
+		ValidLft:  l.ValidLft,
+		State:     l.State,
+		Kind:      RecordKindLease,
+		Source:    source,
+	}
+}
+
+func listByName(ctx context.Context, l Lister, name string) (records []Record, err error) {
+	all, err := l.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range all {
+		if record.Hostname != "" && HostnameMatches(record.Hostname, name) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func listByAddr(ctx context.Context, l Lister, ip net.IP) (records []Record, err error) {
+	all, err := l.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range all {
+		if record.IP.Equal(ip) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func listByIdentifier(ctx context.Context, l Lister, identifierType string, identifier string) (records []Record, err error) {
+	all, err := l.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range all {
+		value := recordIdentifier(record, identifierType)
+		if value != "" && normalizeIdentifier(value) == normalizeIdentifier(identifier) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// recordIdentifier returns a record's identifier of the given type. The
+// client-id of an IPv4 record and the DUID of an IPv6 one share ClientID.
+func recordIdentifier(record Record, identifierType string) string {
+	switch identifierType {
+	case IdentifierHwAddress:
+		mac, _ := recordMAC(record)
+		return mac
+	case IdentifierClientID:
+		if record.IP.To4() != nil {
+			return record.ClientID
+		}
+	case IdentifierDUID:
+		if record.IP.To4() == nil {
+			return record.ClientID
+		}
+	}
+	return ""
+}
+
+// normalizeIdentifier reduces a hardware address, client-id or DUID to
+// lower-case hex digits, so identifiers written with colons, dashes or dots
+// compare equal.
+func normalizeIdentifier(hwAddress string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", "-", "", ".", "").Replace(hwAddress))
+}
+
+// lookupFamilies runs lookup for IPv4 and IPv6 concurrently, as enabled, and
+// returns the IPv4 records followed by the IPv6 ones. If one family fails
+// while the other succeeds, the failure is logged and the other's records
+// are returned.
+func lookupFamilies(useIPv4 bool, useIPv6 bool, lookup func(family int) ([]Record, error)) (records []Record, err error) {
+	var families []int
+	if useIPv4 {
+		families = append(families, 4)
+	}
+	if useIPv6 {
+		families = append(families, 6)
+	}
+
+	results := make([][]Record, len(families))
+	errs := make([]error, len(families))
+	var wg sync.WaitGroup
+	for i, family := range families {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = lookup(family)
+		}()
+	}
+	wg.Wait()
+
+	failed := 0
+	for i := range families {
+		if errs[i] != nil {
+			failed++
+			continue
+		}
+		records = append(records, results[i]...)
+	}
+	if failed > 0 && failed == len(families) {
+		return nil, errors.Join(errs...)
+	}
+	for i, family := range families {
+		if errs[i] != nil {
+			log.Warningf("IPv%d lookup failed: %v", family, errs[i])
+		}
+	}
+	return records, nil
+}
+
+// serviceForFamily returns the Kea service for an address family.
+func serviceForFamily(family int) string {
+	if family == 4 {
+		return KEA_IPV4_SERVICE_NAME
+	}
+	return KEA_IPV6_SERVICE_NAME
+}
@@ -0,0 +1,275 @@
+package kea
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ionothanus/coredns-kea/keaclient"
+)
+
+// testSource is a Source returning fixed records.
+type testSource struct {
+	name    string
+	records []Record
+	err     error
+}
+
+func (s testSource) Name() string { return s.name }
+
+func (s testSource) List(ctx context.Context) ([]Record, error) {
+	return s.records, s.err
+}
+
+func (s testSource) LookupName(ctx context.Context, name string) ([]Record, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return listByName(ctx, s, name)
+}
+
+func (s testSource) LookupAddr(ctx context.Context, ip net.IP) ([]Record, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return listByAddr(ctx, s, ip)
+}
+
+func testRecord(source string, hostname string, ip string) Record {
+	return Record{Hostname: hostname, IP: net.ParseIP(ip), Source: source, Kind: RecordKindLease}
+}
+
+func recordSources(records []Record) string {
+	var sources []string
+	for _, record := range records {
+		sources = append(sources, record.Source+"="+record.IP.String())
+	}
+	return strings.Join(sources, " ")
+}
+
+func TestLookupNameSourcePrecedence(t *testing.T) {
+	leases := testSource{name: SourceControlAgentLeases, records: []Record{
+		testRecord(SourceControlAgentLeases, "laptop", "10.0.0.20"),
+	}}
+	conf := testSource{name: SourceDHCP4Conf, records: []Record{
+		testRecord(SourceDHCP4Conf, "laptop", "10.0.0.20"),
+		testRecord(SourceDHCP4Conf, "laptop", "10.0.0.21"),
+		testRecord(SourceDHCP4Conf, "printer", "10.0.0.22"),
+	}}
+
+	tests := []struct {
+		sources  []Source
+		expected string
+	}{
+		{[]Source{leases, conf}, "control_agent_leases=10.0.0.20 dhcp4_conf=10.0.0.21"},
+		{[]Source{conf, leases}, "dhcp4_conf=10.0.0.20 dhcp4_conf=10.0.0.21"},
+		{[]Source{leases}, "control_agent_leases=10.0.0.20"},
+	}
+	for i, test := range tests {
+		kea := Kea{Sources: test.sources}
+		records, err := kea.LookupName(context.Background(), "laptop")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := recordSources(records); actual != test.expected {
+			t.Errorf("Test %d: expected %q, got %q", i, test.expected, actual)
+		}
+	}
+}
+
+func TestOrderSources(t *testing.T) {
+	sources := []Source{
+		testSource{name: SourceControlAgentLeases},
+		testSource{name: SourceDHCP4Conf},
+	}
+
+	ordered, err := OrderSources(sources, []string{SourceDHCP4Conf, SourceControlAgentLeases})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ordered[0].Name() != SourceDHCP4Conf || ordered[1].Name() != SourceControlAgentLeases {
+		t.Errorf("unexpected order %v", ordered)
+	}
+
+	for _, names := range [][]string{
+		{"nonexistent"},
+		{SourceLeaseDB},
+		{SourceDHCP4Conf, SourceDHCP4Conf},
+	} {
+		if _, err := OrderSources(sources, names); err == nil {
+			t.Errorf("%v: expected an error", names)
+		}
+	}
+}
+
+func TestConfiguredSourcesWithoutControlAgent(t *testing.T) {
+	kea := MakeTestKeaConfFiles()
+	for _, source := range kea.ConfiguredSources() {
+		if source.Name() == SourceControlAgentLeases || source.Name() == SourceControlAgentReservations {
+			t.Errorf("unexpected %s source without a control agent", source.Name())
+		}
+	}
+}
+
+func TestConfSourceLookupAddr(t *testing.T) {
+	kea := MakeTestKeaConfFiles()
+	for _, source := range kea.ConfiguredSources() {
+		records, err := source.LookupAddr(context.Background(), net.ParseIP("10.0.0.150"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if source.Name() == SourceDHCP4Conf && (len(records) != 1 || records[0].Hostname != "host1") {
+			t.Errorf("expected host1 reservation, got %v", records)
+		}
+		if source.Name() == SourceDHCP6Conf && len(records) != 0 {
+			t.Errorf("expected no IPv6 reservation, got %v", records)
+		}
+	}
+}
+
+func TestLookupNamePartialResults(t *testing.T) {
+	leases := testSource{name: SourceControlAgentLeases, records: []Record{
+		testRecord(SourceControlAgentLeases, "laptop", "10.0.0.20"),
+	}}
+	reservations := testSource{name: SourceControlAgentReservations, err: errors.New("command not supported")}
+
+	kea := Kea{Sources: []Source{reservations, leases}}
+	records, err := kea.LookupName(context.Background(), "laptop")
+	if err != nil {
+		t.Fatalf("expected partial results without an error, got %v", err)
+	}
+	if actual := recordSources(records); actual != "control_agent_leases=10.0.0.20" {
+		t.Errorf("unexpected results %q", actual)
+	}
+
+	kea = Kea{Sources: []Source{reservations}}
+	if _, err := kea.LookupName(context.Background(), "laptop"); err == nil {
+		t.Error("expected an error when every source fails")
+	}
+}
+
+func TestResultErrors(t *testing.T) {
+	unsupported := &keaclient.ResultError{
+		Command: "lease6-get-by-hostname",
+		Service: KEA_IPV6_SERVICE_NAME,
+		Result:  keaclient.Unsupported,
+		Text:    "'lease6-get-by-hostname' command not supported.",
+	}
+
+	var results resultErrors
+	results.add(nil)
+	results.add(unsupported)
+	if err := results.err(); err != nil {
+		t.Errorf("expected no error when one service answered, got %v", err)
+	}
+
+	results = resultErrors{}
+	results.add(unsupported)
+	if err := results.err(); !errors.Is(err, keaclient.ErrUnsupported) {
+		t.Errorf("expected the Kea error when no service answered, got %v", err)
+	}
+}
+
+// slowSource waits before answering, or until the lookup is cancelled.
+type slowSource struct {
+	testSource
+	delay time.Duration
+}
+
+func (s slowSource) LookupName(ctx context.Context, name string) ([]Record, error) {
+	select {
+	case <-time.After(s.delay):
+		return s.testSource.LookupName(ctx, name)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestLookupNameConcurrent(t *testing.T) {
+	var sources []Source
+	for i, name := range []string{SourceControlAgentLeases, SourceControlAgentReservations, SourceDHCP4Conf} {
+		sources = append(sources, slowSource{
+			testSource: testSource{name: name, records: []Record{
+				testRecord(name, "laptop", fmt.Sprintf("10.0.0.%d", 20+i)),
+			}},
+			// Later sources answer first, to check the merge order.
+			delay: time.Duration(3-i) * 50 * time.Millisecond,
+		})
+	}
+
+	kea := Kea{Sources: sources}
+	start := time.Now()
+	records, err := kea.LookupName(context.Background(), "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= 300*time.Millisecond {
+		t.Errorf("expected sources to be queried concurrently, took %v", elapsed)
+	}
+	expected := "control_agent_leases=10.0.0.20 control_agent_reservations=10.0.0.21 dhcp4_conf=10.0.0.22"
+	if actual := recordSources(records); actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestLookupNameTimeout(t *testing.T) {
+	fast := testSource{name: SourceDHCP4Conf, records: []Record{
+		testRecord(SourceDHCP4Conf, "laptop", "10.0.0.20"),
+	}}
+	slow := slowSource{
+		testSource: testSource{name: SourceControlAgentLeases, records: []Record{
+			testRecord(SourceControlAgentLeases, "laptop", "10.0.0.21"),
+		}},
+		delay: time.Minute,
+	}
+
+	kea := Kea{Sources: []Source{slow, fast}, LookupTimeout: 50 * time.Millisecond}
+	start := time.Now()
+	records, err := kea.LookupName(context.Background(), "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("expected the lookup to stop at the deadline, took %v", elapsed)
+	}
+	if actual := recordSources(records); actual != "dhcp4_conf=10.0.0.20" {
+		t.Errorf("unexpected results %q", actual)
+	}
+}
+
+func TestLookupFamilies(t *testing.T) {
+	records, err := lookupFamilies(true, true, func(family int) ([]Record, error) {
+		if family == 4 {
+			time.Sleep(20 * time.Millisecond)
+			return []Record{testRecord("test", "laptop", "10.0.0.20")}, nil
+		}
+		return []Record{testRecord("test", "laptop", "2001:db8::20")}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := recordSources(records); actual != "test=10.0.0.20 test=2001:db8::20" {
+		t.Errorf("expected IPv4 before IPv6, got %q", actual)
+	}
+
+	records, err = lookupFamilies(true, true, func(family int) ([]Record, error) {
+		if family == 4 {
+			return nil, errors.New("unavailable")
+		}
+		return []Record{testRecord("test", "laptop", "2001:db8::20")}, nil
+	})
+	if err != nil || len(records) != 1 {
+		t.Errorf("expected IPv6 results despite the IPv4 failure, got %v, %v", records, err)
+	}
+
+	_, err = lookupFamilies(true, false, func(family int) ([]Record, error) {
+		return nil, errors.New("unavailable")
+	})
+	if err == nil {
+		t.Error("expected an error when every family fails")
+	}
+}
@@ -0,0 +1,156 @@
+package kea
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ionothanus/coredns-kea/keaclient"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// How often statistic-get-all is sent, unless the statistics directive
+// sets an interval.
+const defaultStatisticsInterval = 30 * time.Second
+
+// subnetStatistic matches per-subnet statistics, such as
+// "subnet[1].assigned-addresses"; pool statistics don't match.
+var subnetStatistic = regexp.MustCompile(`^subnet\[(\d+)\]\.([a-z-]+)$`)
+
+// subnetGauges maps the per-subnet statistics of each service to the gauge
+// exporting them.
+var subnetGauges = map[string]map[string]*prometheus.GaugeVec{
+	KEA_IPV4_SERVICE_NAME: {
+		"assigned-addresses": subnetAssignedAddresses,
+		"total-addresses":    subnetTotalAddresses,
+		"declined-addresses": subnetDeclinedAddresses,
+	},
+	KEA_IPV6_SERVICE_NAME: {
+		"assigned-nas":       subnetAssignedAddresses,
+		"total-nas":          subnetTotalAddresses,
+		"declined-addresses": subnetDeclinedAddresses,
+	},
+}
+
+// statisticSeries is one exported value.
+type statisticSeries struct {
+	gauge  *prometheus.GaugeVec
+	labels [3]string
+}
+
+// StatisticsCollector periodically sends statistic-get-all to a Kea server
+// and exports its address and packet statistics.
+type StatisticsCollector struct {
+	// Backend names the Kea server, when several are configured.
+	Backend   string
+	Endpoints *EndpointPool
+	Services  []string
+	Interval  time.Duration
+
+	// Only used by Collect, which isn't called concurrently.
+	exported map[string]map[statisticSeries]bool
+	failing  map[string]bool
+
+	loop loop
+}
+
+func NewStatisticsCollector(backend string, endpoints *EndpointPool, services []string, interval time.Duration) *StatisticsCollector {
+	return &StatisticsCollector{
+		Backend:   backend,
+		Endpoints: endpoints,
+		Services:  services,
+		Interval:  interval,
+		exported:  map[string]map[statisticSeries]bool{},
+		failing:   map[string]bool{},
+	}
+}
+
+// Collect fetches each service's statistics and updates the gauges. A
+// service which fails keeps its last values; failures are logged when a
+// service starts or stops failing.
+func (s *StatisticsCollector) Collect(ctx context.Context) error {
+	var errs []error
+	for _, service := range s.Services {
+		err := s.collect(ctx, service)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if err != nil && !s.failing[service] {
+			log.Warningf("Failed to get %s statistics from Kea%s: %v", service, s.label(), err)
+		} else if err == nil && s.failing[service] {
+			log.Infof("Getting %s statistics from Kea%s again", service, s.label())
+		}
+		s.failing[service] = err != nil
+	}
+	return errors.Join(errs...)
+}
+
+func (s *StatisticsCollector) collect(ctx context.Context, service string) error {
+	if !s.Endpoints.Supports(service, "statistic-get-all") {
+		return nil
+	}
+	replies, err := keaclient.Client{Transport: s.Endpoints}.StatisticGetAll(ctx, service)
+	if err != nil {
+		return err
+	}
+	if len(replies) == 0 {
+		return errors.New("statistic-get-all returned no response")
+	}
+	if err = replies[0].Err(); err != nil {
+		return err
+	}
+
+	exported := map[statisticSeries]bool{}
+	for name := range replies[0].Arguments {
+		value, ok := replies[0].Arguments.Value(name)
+		if !ok {
+			continue
+		}
+		var series statisticSeries
+		if match := subnetStatistic.FindStringSubmatch(name); match != nil {
+			gauge, ok := subnetGauges[service][match[2]]
+			if !ok {
+				continue
+			}
+			series = statisticSeries{gauge, [3]string{s.Backend, service, match[1]}}
+		} else if packetType, ok := strings.CutPrefix(name, "pkt"+strings.TrimPrefix(service, "dhcp")+"-"); ok {
+			series = statisticSeries{packets, [3]string{s.Backend, service, packetType}}
+		} else {
+			continue
+		}
+		series.gauge.WithLabelValues(series.labels[:]...).Set(value)
+		exported[series] = true
+	}
+
+	// Subnets which were removed from Kea's configuration are no longer
+	// reported.
+	for series := range s.exported[service] {
+		if !exported[series] {
+			series.gauge.DeleteLabelValues(series.labels[:]...)
+		}
+	}
+	s.exported[service] = exported
+	return nil
+}
+
+func (s *StatisticsCollector) label() string {
+	if s.Backend == "" {
+		return ""
+	}
+	return " for " + s.Backend
+}
+
+// Start collects the statistics now, and then every Interval.
+func (s *StatisticsCollector) Start() {
+	s.loop.start(s.Interval, discoveryTimeout, true, func(ctx context.Context) {
+		s.Collect(withBackground(ctx))
+	})
+}
+
+// Stop ends the collection started by Start.
+func (s *StatisticsCollector) Stop() {
+	s.loop.stop()
+}
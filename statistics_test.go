@@ -0,0 +1,92 @@
+package kea
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ionothanus/coredns-kea/keatest"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStatisticsCollector(t *testing.T) {
+	server := keatest.NewControlAgent(t, testFixture(t))
+	server.SetStatistics(keatest.DHCP4, map[string]float64{
+		"pkt4-received":                          120,
+		"pkt4-ack-sent":                          40,
+		"subnet[1].assigned-addresses":           2,
+		"subnet[1].total-addresses":              90,
+		"subnet[1].declined-addresses":           1,
+		"subnet[1].pool[0].assigned-addresses":   2,
+		"subnet[2].assigned-addresses":           5,
+		"subnet[2].total-addresses":              10,
+		"subnet[2].reclaimed-declined-addresses": 3,
+	})
+	server.SetStatistics(keatest.DHCP6, map[string]float64{
+		"pkt6-received":                4,
+		"pkt4-received":                7,
+		"subnet[1].assigned-nas":       1,
+		"subnet[1].total-nas":          65536,
+		"subnet[1].declined-addresses": 0,
+		"subnet[1].assigned-pds":       1,
+	})
+
+	pool := NewEndpointPool([]string{server.URL}, false, []string{KEA_IPV4_SERVICE_NAME, KEA_IPV6_SERVICE_NAME}, false)
+	collector := NewStatisticsCollector("stats", pool, []string{KEA_IPV4_SERVICE_NAME, KEA_IPV6_SERVICE_NAME}, defaultStatisticsInterval)
+	if err := collector.Collect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		name     string
+		actual   float64
+		expected float64
+	}{
+		{"dhcp4 subnet 1 assigned", testutil.ToFloat64(subnetAssignedAddresses.WithLabelValues("stats", "dhcp4", "1")), 2},
+		{"dhcp4 subnet 1 total", testutil.ToFloat64(subnetTotalAddresses.WithLabelValues("stats", "dhcp4", "1")), 90},
+		{"dhcp4 subnet 1 declined", testutil.ToFloat64(subnetDeclinedAddresses.WithLabelValues("stats", "dhcp4", "1")), 1},
+		{"dhcp4 subnet 2 assigned", testutil.ToFloat64(subnetAssignedAddresses.WithLabelValues("stats", "dhcp4", "2")), 5},
+		{"dhcp4 received", testutil.ToFloat64(packets.WithLabelValues("stats", "dhcp4", "received")), 120},
+		{"dhcp4 ack-sent", testutil.ToFloat64(packets.WithLabelValues("stats", "dhcp4", "ack-sent")), 40},
+		{"dhcp6 subnet 1 assigned", testutil.ToFloat64(subnetAssignedAddresses.WithLabelValues("stats", "dhcp6", "1")), 1},
+		{"dhcp6 subnet 1 total", testutil.ToFloat64(subnetTotalAddresses.WithLabelValues("stats", "dhcp6", "1")), 65536},
+		{"dhcp6 received", testutil.ToFloat64(packets.WithLabelValues("stats", "dhcp6", "received")), 4},
+	}
+	for _, e := range expected {
+		if e.actual != e.expected {
+			t.Errorf("%s: expected %v, got %v", e.name, e.expected, e.actual)
+		}
+	}
+
+	// Only the statistics of the service's own family are exported.
+	if count := testutil.CollectAndCount(packets); count != 3 {
+		t.Errorf("expected 3 packet counters, got %d", count)
+	}
+
+	// Subnets removed from Kea stop being exported.
+	server.SetStatistics(keatest.DHCP4, map[string]float64{
+		"subnet[1].assigned-addresses": 3,
+		"subnet[1].total-addresses":    90,
+	})
+	if err := collector.Collect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if assigned := testutil.ToFloat64(subnetAssignedAddresses.WithLabelValues("stats", "dhcp4", "1")); assigned != 3 {
+		t.Errorf("expected 3 assigned addresses, got %v", assigned)
+	}
+	if subnetTotalAddresses.DeleteLabelValues("stats", "dhcp4", "2") {
+		t.Error("expected subnet 2 to no longer be exported")
+	}
+	if packets.DeleteLabelValues("stats", "dhcp4", "received") {
+		t.Error("expected dhcp4 packet counters to no longer be exported")
+	}
+
+	// A failed service keeps its last values.
+	server.Inject(keatest.Fault{Command: "statistic-get-all", HTTPStatus: 500})
+	if err := collector.Collect(context.Background()); err == nil {
+		t.Fatal("expected collection to fail")
+	}
+	if assigned := testutil.ToFloat64(subnetAssignedAddresses.WithLabelValues("stats", "dhcp4", "1")); assigned != 3 {
+		t.Errorf("expected 3 assigned addresses to be kept, got %v", assigned)
+	}
+}
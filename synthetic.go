@@ -0,0 +1,271 @@
+package kea
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnsutil"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// Placeholders a synthetic name template may contain.
+const (
+	syntheticIP  = "{ip}"
+	syntheticMAC = "{mac}"
+)
+
+var syntheticPlaceholder = regexp.MustCompile(`\{ip\}|\{mac\}`)
+
+// SyntheticName generates names for leases whose client sent no hostname,
+// from a template such as "ip-{ip}" or "{mac}.dhcp.lan".
+type SyntheticName struct {
+	// Template includes the qualifying suffix, if any.
+	Template string
+	// Networks limits the template to leases in these networks. When empty
+	// it applies to every lease.
+	Networks []string
+
+	pattern      *regexp.Regexp
+	placeholders []string
+}
+
+// NewSyntheticName parses a template. A template without placeholders is a
+// prefix, used the way Kea uses ddns-generated-prefix: "myhost" names the
+// lease of 10.0.0.5 "myhost-10-0-0-5". A suffix is appended like Kea's
+// ddns-qualifying-suffix, so "myhost" with the suffix "dhcp.lan" names it
+// "myhost-10-0-0-5.dhcp.lan".
+func NewSyntheticName(template string, suffix string, networks []string) (SyntheticName, error) {
+	if !strings.Contains(template, "{") {
+		template += "-" + syntheticIP
+	}
+	if suffix = strings.Trim(suffix, "."); suffix != "" {
+		template += "." + suffix
+	}
+	template = strings.ToLower(template)
+	literal := syntheticPlaceholder.ReplaceAllString(template, "")
+	if strings.ContainsAny(literal, "{}") {
+		return SyntheticName{}, fmt.Errorf("unknown placeholder in synthetic name template %q", template)
+	}
+	for _, network := range networks {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			return SyntheticName{}, fmt.Errorf("invalid synthetic name network %q", network)
+		}
+	}
+
+	var pattern strings.Builder
+	var placeholders []string
+	pattern.WriteString("^")
+	last := 0
+	for _, loc := range syntheticPlaceholder.FindAllStringIndex(template, -1) {
+		pattern.WriteString(regexp.QuoteMeta(template[last:loc[0]]))
+		placeholder := template[loc[0]:loc[1]]
+		if placeholder == syntheticIP {
+			pattern.WriteString(`([0-9a-f-]+)`)
+		} else {
+			pattern.WriteString(`([0-9a-f]{2}(?:-[0-9a-f]{2})+)`)
+		}
+		placeholders = append(placeholders, placeholder)
+		last = loc[1]
+	}
+	pattern.WriteString(regexp.QuoteMeta(template[last:]))
+	pattern.WriteString("$")
+
+	return SyntheticName{
+		Template:     template,
+		Networks:     networks,
+		pattern:      regexp.MustCompile(pattern.String()),
+		placeholders: placeholders,
+	}, nil
+}
+
+// Name returns the name the template gives a record: the address with dots
+// or colons replaced by dashes for {ip}, and the hardware address with dashes
+// between its bytes for {mac}. It is empty when the record has no hardware
+// address and the template needs one.
+func (s SyntheticName) Name(record Record) string {
+	name := strings.ReplaceAll(s.Template, syntheticIP, strings.NewReplacer(".", "-", ":", "-").Replace(record.IP.String()))
+	if strings.Contains(name, syntheticMAC) {
+		hwAddress := normalizeIdentifier(record.HwAddress)
+		if hwAddress == "" || len(hwAddress)%2 != 0 {
+			return ""
+		}
+		name = strings.ReplaceAll(name, syntheticMAC, splitHex(hwAddress, "-"))
+	}
+	return name
+}
+
+// Contains reports whether the template applies to an address.
+func (s SyntheticName) Contains(ip net.IP) bool {
+	if len(s.Networks) == 0 {
+		return true
+	}
+	for _, cidr := range s.Networks {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// subject returns the part of a query name the template is compared with:
+// the whole name when the template has a dot, and its first label otherwise.
+func (s SyntheticName) subject(qname string) string {
+	name := strings.ToLower(strings.TrimSuffix(qname, "."))
+	if !strings.Contains(s.Template, ".") {
+		name, _, _ = strings.Cut(name, ".")
+	}
+	return name
+}
+
+// match extracts the address or hardware address a query name was generated
+// from.
+func (s SyntheticName) match(qname string) (ip net.IP, hwAddress string, ok bool) {
+	groups := s.pattern.FindStringSubmatch(s.subject(qname))
+	if groups == nil {
+		return nil, "", false
+	}
+	for i, placeholder := range s.placeholders {
+		value := groups[i+1]
+		if placeholder == syntheticMAC {
+			hwAddress = strings.ReplaceAll(value, "-", ":")
+			continue
+		}
+		ip = net.ParseIP(strings.ReplaceAll(value, "-", "."))
+		if ip == nil || ip.To4() == nil {
+			ip = net.ParseIP(strings.ReplaceAll(value, "-", ":"))
+		}
+		if ip == nil {
+			return nil, "", false
+		}
+	}
+	return ip, hwAddress, true
+}
+
+// splitHex separates every byte of a hex string.
+func splitHex(hex string, separator string) string {
+	var parts []string
+	for i := 0; i+1 < len(hex); i += 2 {
+		parts = append(parts, hex[i:i+2])
+	}
+	return strings.Join(parts, separator)
+}
+
+// syntheticName returns the name the first template for a record's network
+// gives it. Only leases without a hostname are given one.
+func (k Kea) syntheticName(record Record) string {
+	if record.Kind != RecordKindLease || record.Hostname != "" {
+		return ""
+	}
+	for _, synthetic := range k.SyntheticNames {
+		if synthetic.Contains(record.IP) {
+			return synthetic.Name(record)
+		}
+	}
+	return ""
+}
+
+// LookupSynthetic finds the leases a synthetic name was generated for, by
+// their address or hardware address, and returns them with the name as
+// their hostname.
+func (k Kea) LookupSynthetic(ctx context.Context, qname string) (records []Record, err error) {
+	var errs []error
+	for _, synthetic := range k.SyntheticNames {
+		ip, hwAddress, ok := synthetic.match(qname)
+		if !ok {
+			continue
+		}
+		var candidates []Record
+		if ip != nil {
+			candidates, err = k.LookupAddr(ctx, ip)
+		} else {
+			candidates, err = k.LookupIdentifier(ctx, IdentifierHwAddress, hwAddress)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		name := synthetic.subject(qname)
+		for _, record := range candidates {
+			if k.syntheticName(record) != name || containsIP(records, record) {
+				continue
+			}
+			record.Hostname = name
+			records = append(records, record)
+		}
+	}
+	if len(records) == 0 && len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return records, nil
+}
+
+// answersPTR reports whether a reverse lookup for an address could be
+// answered, so Kea is only asked about addresses in networks whose template
+// gives fully qualified names.
+func (k Kea) answersPTR(ip net.IP) bool {
+	if published, err := k.FilterRecords([]Record{{IP: ip}}); err != nil || len(published) == 0 {
+		return false
+	}
+	for _, synthetic := range k.SyntheticNames {
+		if synthetic.Contains(ip) {
+			return strings.Contains(synthetic.Template, ".")
+		}
+	}
+	return false
+}
+
+// servePTR answers a reverse lookup with the synthetic name of the lease for
+// the address. Only names from templates with a dot or a suffix are
+// returned, as the others aren't fully qualified.
+func (k Kea) servePTR(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, state request.Request, server string) (int, error) {
+	ip := net.ParseIP(dnsutil.ExtractAddressFromReverse(state.Name()))
+	if ip == nil || !k.answersPTR(ip) {
+		queryOutcomes.WithLabelValues(server, state.Type(), OutcomeFallthrough).Inc()
+		return plugin.NextOrFailure(k.Name(), k.Next, ctx, w, r)
+	}
+
+	records, err := k.LookupAddr(ctx, ip)
+	if err != nil {
+		queryOutcomes.WithLabelValues(server, state.Type(), OutcomeError).Inc()
+		return plugin.NextOrFailure(k.Name(), k.Next, ctx, w, r)
+	}
+
+	for _, record := range records {
+		name := k.syntheticName(record)
+		if !strings.Contains(name, ".") {
+			continue
+		}
+		record.Hostname = name
+		setAnswered(ctx, record)
+
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.RecursionAvailable = false
+		m.Answer = append(m.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   state.QName(),
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    60,
+			},
+			Ptr: dns.Fqdn(name),
+		})
+		queryOutcomes.WithLabelValues(server, state.Type(), OutcomeAnswered).Inc()
+		return 0, w.WriteMsg(m)
+	}
+
+	outcome := OutcomeFallthrough
+	if len(records) > 0 {
+		outcome = OutcomeNoData
+	}
+	queryOutcomes.WithLabelValues(server, state.Type(), outcome).Inc()
+	return plugin.NextOrFailure(k.Name(), k.Next, ctx, w, r)
+}
@@ -0,0 +1,194 @@
+package kea
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/ionothanus/coredns-kea/keaclient"
+	"github.com/ionothanus/coredns-kea/keatest"
+
+	"github.com/miekg/dns"
+)
+
+func TestSyntheticName(t *testing.T) {
+	tests := []struct {
+		template string
+		suffix   string
+		record   Record
+		expected string
+	}{
+		{"myhost", "", Record{IP: net.ParseIP("10.0.0.5")}, "myhost-10-0-0-5"},
+		{"myhost", "", Record{IP: net.ParseIP("2001:db8:1::20")}, "myhost-2001-db8-1--20"},
+		{"myhost", "dhcp.lan.", Record{IP: net.ParseIP("10.0.0.5")}, "myhost-10-0-0-5.dhcp.lan"},
+		{"ip-{ip}.dhcp.lan", "", Record{IP: net.ParseIP("10.0.0.5")}, "ip-10-0-0-5.dhcp.lan"},
+		{"{MAC}.dhcp.lan", "", Record{IP: net.ParseIP("10.0.0.5"), HwAddress: "00:11:22:AA:BB:CC"}, "00-11-22-aa-bb-cc.dhcp.lan"},
+		{"{mac}", "Dhcp.Lan", Record{IP: net.ParseIP("10.0.0.5"), HwAddress: "00:11:22:AA:BB:CC"}, "00-11-22-aa-bb-cc.dhcp.lan"},
+		{"{mac}.dhcp.lan", "", Record{IP: net.ParseIP("10.0.0.5")}, ""},
+	}
+
+	for i, tc := range tests {
+		synthetic, err := NewSyntheticName(tc.template, tc.suffix, nil)
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		name := synthetic.Name(tc.record)
+		if name != tc.expected {
+			t.Errorf("Test %d: expected %q, got %q", i, tc.expected, name)
+		}
+		if name == "" {
+			continue
+		}
+		ip, hwAddress, ok := synthetic.match(name + ".")
+		if !ok {
+			t.Errorf("Test %d: %q doesn't match its own template", i, name)
+		}
+		if ip != nil && !ip.Equal(tc.record.IP) {
+			t.Errorf("Test %d: expected %s from %q, got %s", i, tc.record.IP, name, ip)
+		}
+		if hwAddress != "" && normalizeIdentifier(hwAddress) != normalizeIdentifier(tc.record.HwAddress) {
+			t.Errorf("Test %d: expected %s from %q, got %s", i, tc.record.HwAddress, name, hwAddress)
+		}
+	}
+
+	for _, template := range []string{"{name}.dhcp.lan", "ip-{ip"} {
+		if _, err := NewSyntheticName(template, "", nil); err == nil {
+			t.Errorf("Expected %q to be rejected", template)
+		}
+	}
+}
+
+func TestServeSynthetic(t *testing.T) {
+	fixture := testFixture(t)
+	fixture.Leases = append(fixture.Leases,
+		keaclient.Lease{IPAddress: "10.0.0.30", HwAddress: "00:11:22:33:44:99", SubnetID: 1, ValidLft: 3600},
+		keaclient.Lease{IPAddress: "2001:db8:1::30", DUID: "00:03:00:01:00:11:22:33:44:99", SubnetID: 1, ValidLft: 3600},
+		keaclient.Lease{IPAddress: "2001:db8:2::30", DUID: "00:03:00:01:00:11:22:33:44:9a", SubnetID: 2, ValidLft: 3600},
+	)
+	server := keatest.NewControlAgent(t, fixture)
+
+	byMAC, err := NewSyntheticName("{mac}.dhcp.lan", "", []string{"10.0.0.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byPrefix, err := NewSyntheticName("myhost", "dhcp.lan", []string{"2001:db8:1::/64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byIP, err := NewSyntheticName("ip-{ip}", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kea := Kea{
+		ControlAgents:            []string{server.URL},
+		ControlAgentLeases:       "true",
+		ControlAgentReservations: "true",
+		UseIPv4:                  "true",
+		UseIPv6:                  "true",
+		ExtractHostname:          "true",
+		SyntheticNames:           []SyntheticName{byMAC, byPrefix, byIP},
+		Next:                     fallthroughHandler(),
+	}
+
+	disabled := kea
+	disabled.SyntheticNames = nil
+
+	tests := []struct {
+		kea Kea
+		test.Case
+	}{
+		{kea, test.Case{
+			Qname: "00-11-22-33-44-99.dhcp.lan.", Qtype: dns.TypeA, Authoritative: true,
+			Answer: []dns.RR{test.A("00-11-22-33-44-99.dhcp.lan. 60 IN A 10.0.0.30")},
+		}},
+		{kea, test.Case{
+			Qname: "ip-2001-db8-2--30.example.org.", Qtype: dns.TypeAAAA, Authoritative: true,
+			Answer: []dns.RR{test.AAAA("ip-2001-db8-2--30.example.org. 60 IN AAAA 2001:db8:2::30")},
+		}},
+		{kea, test.Case{
+			Qname: "myhost-2001-db8-1--30.dhcp.lan.", Qtype: dns.TypeAAAA, Authoritative: true,
+			Answer: []dns.RR{test.AAAA("myhost-2001-db8-1--30.dhcp.lan. 60 IN AAAA 2001:db8:1::30")},
+		}},
+		// The suffix is part of the name.
+		{kea, test.Case{Qname: "myhost-2001-db8-1--30.example.org.", Qtype: dns.TypeAAAA, Rcode: dns.RcodeNameError}},
+		{kea, test.Case{
+			Qname: "30.0.0.10.in-addr.arpa.", Qtype: dns.TypePTR, Authoritative: true,
+			Answer: []dns.RR{test.PTR("30.0.0.10.in-addr.arpa. 60 IN PTR 00-11-22-33-44-99.dhcp.lan.")},
+		}},
+		// The first template for a lease's network is the only one it
+		// answers to.
+		{kea, test.Case{Qname: "ip-10-0-0-30.example.org.", Qtype: dns.TypeA, Rcode: dns.RcodeNameError}},
+		// Clients which sent a hostname aren't given a synthetic name.
+		{kea, test.Case{Qname: "myhost-2001-db8-1--20.dhcp.lan.", Qtype: dns.TypeAAAA, Rcode: dns.RcodeNameError}},
+		{kea, test.Case{Qname: "20.0.0.10.in-addr.arpa.", Qtype: dns.TypePTR, Rcode: dns.RcodeNameError}},
+		// Prefixes with a suffix are returned by reverse lookups, but names
+		// from templates with neither a dot nor a suffix aren't.
+		{kea, test.Case{
+			Qname: "0.3.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.1.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", Qtype: dns.TypePTR, Authoritative: true,
+			Answer: []dns.RR{test.PTR("0.3.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.1.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa. 60 IN PTR myhost-2001-db8-1--30.dhcp.lan.")},
+		}},
+		{kea, test.Case{
+			Qname: "0.3.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.2.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", Qtype: dns.TypePTR,
+			Rcode: dns.RcodeNameError,
+		}},
+		{disabled, test.Case{Qname: "00-11-22-33-44-99.dhcp.lan.", Qtype: dns.TypeA, Rcode: dns.RcodeNameError}},
+		{disabled, test.Case{Qname: "30.0.0.10.in-addr.arpa.", Qtype: dns.TypePTR, Rcode: dns.RcodeNameError}},
+	}
+
+	for i, tc := range tests {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, err := tc.kea.ServeDNS(context.Background(), rec, tc.Msg())
+		if err != nil {
+			t.Errorf("Test %d: unexpected error %v", i, err)
+			continue
+		}
+		if rcode != tc.Rcode {
+			t.Errorf("Test %d: expected rcode %s, got %s", i, dns.RcodeToString[tc.Rcode], dns.RcodeToString[rcode])
+		}
+		if rec.Msg == nil {
+			t.Errorf("Test %d: no response written", i)
+			continue
+		}
+		if err := test.SortAndCheck(rec.Msg, tc.Case); err != nil {
+			t.Errorf("Test %d: %v", i, err)
+		}
+	}
+}
+
+func TestServePTROutsideTemplates(t *testing.T) {
+	server := keatest.NewControlAgent(t, testFixture(t))
+
+	byMAC, err := NewSyntheticName("{mac}.dhcp.lan", "", []string{"10.0.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byIP, err := NewSyntheticName("ip-{ip}", "", []string{"10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kea := Kea{
+		ControlAgents:      []string{server.URL},
+		ControlAgentLeases: "true",
+		UseIPv4:            "true",
+		Networks:           []string{"10.0.0.0/24", "10.1.0.0/24"},
+		SyntheticNames:     []SyntheticName{byMAC, byIP},
+		Next:               fallthroughHandler(),
+	}
+
+	// Addresses outside every template, outside networks, and covered by a
+	// template without a dot are passed on without asking Kea.
+	for _, qname := range []string{"1.1.168.192.in-addr.arpa.", "1.1.0.10.in-addr.arpa.", "1.0.1.10.in-addr.arpa."} {
+		sent := len(server.Sent())
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, err := kea.ServeDNS(context.Background(), rec, test.Case{Qname: qname, Qtype: dns.TypePTR}.Msg())
+		if err != nil || rcode != dns.RcodeNameError {
+			t.Errorf("%s: expected NXDOMAIN from the next plugin, got %s, %v", qname, dns.RcodeToString[rcode], err)
+		}
+		if commands := server.Sent()[sent:]; len(commands) > 0 {
+			t.Errorf("%s: expected no request to Kea, got %v", qname, commands)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package kea
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/ionothanus/coredns-kea/keaclient"
+
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+// startSpan starts a child of the span in ctx, when the query is traced by
+// the trace plugin. It returns a nil span otherwise.
+func startSpan(ctx context.Context, operation string) (ot.Span, context.Context) {
+	parent := ot.SpanFromContext(ctx)
+	if parent == nil {
+		return nil, ctx
+	}
+	span := parent.Tracer().StartSpan(operation, ot.ChildOf(parent.Context()))
+	return span, ot.ContextWithSpan(ctx, span)
+}
+
+// finishSpan marks a span as failed if err is set, and finishes it.
+func finishSpan(span ot.Span, err error) {
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.SetTag("kea.error", err.Error())
+	}
+	span.Finish()
+}
+
+// finishLookupSpan finishes the span of a source lookup, tagged with the
+// number of records it found.
+func finishLookupSpan(span ot.Span, source Source, hits int, err error) {
+	if span == nil {
+		return
+	}
+	span.SetTag("kea.source", source.Name())
+	if backend := sourceBackend(source); backend != "" {
+		span.SetTag("kea.backend", backend)
+	}
+	span.SetTag("kea.hits", hits)
+	finishSpan(span, err)
+}
+
+// finishRequestSpan finishes the span of a request to a Kea endpoint, tagged
+// with the result codes of the replies.
+func finishRequestSpan(span ot.Span, command keaclient.Command, endpoint *Endpoint, responseBody []byte, err error) {
+	if span == nil {
+		return
+	}
+	span.SetTag("kea.command", command.Command)
+	if len(command.Service) > 0 {
+		span.SetTag("kea.service", strings.Join(command.Service, ","))
+	}
+	span.SetTag("kea.endpoint", endpoint.URL)
+	if err == nil {
+		replies, decodeErr := keaclient.Decode[json.RawMessage](command, responseBody)
+		if decodeErr == nil {
+			var results []string
+			for _, reply := range replies {
+				results = append(results, reply.Result.String())
+			}
+			span.SetTag("kea.result", strings.Join(results, ","))
+		}
+	}
+	finishSpan(span, err)
+}
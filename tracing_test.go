@@ -0,0 +1,67 @@
+package kea
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ionothanus/coredns-kea/keatest"
+
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestLookupNameSpans(t *testing.T) {
+	kea, server := MakeTestKeaControlAgent(t)
+	kea.ControlAgentReservations = "false"
+	server.Inject(keatest.Fault{Command: "lease6-get-by-hostname", HTTPStatus: 500})
+
+	tracer := mocktracer.New()
+	root := tracer.StartSpan("kea")
+	ctx := ot.ContextWithSpan(context.Background(), root)
+	if _, err := kea.LookupName(ctx, "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	root.Finish()
+
+	spans := map[string][]*mocktracer.MockSpan{}
+	for _, span := range tracer.FinishedSpans() {
+		spans[span.OperationName] = append(spans[span.OperationName], span)
+	}
+
+	if len(spans["kea.lookup"]) != 1 {
+		t.Fatalf("expected a span for the lease lookup, got %d", len(spans["kea.lookup"]))
+	}
+	lookup := spans["kea.lookup"][0]
+	if lookup.ParentID != root.(*mocktracer.MockSpan).SpanContext.SpanID {
+		t.Error("expected the lookup span to be a child of the query's span")
+	}
+	if lookup.Tag("kea.source") != SourceControlAgentLeases || lookup.Tag("kea.hits") != 1 {
+		t.Errorf("unexpected lookup tags %v", lookup.Tags())
+	}
+
+	requests := map[string]*mocktracer.MockSpan{}
+	for _, span := range spans["kea.request"] {
+		requests[span.Tag("kea.command").(string)] = span
+		if span.ParentID != lookup.SpanContext.SpanID {
+			t.Error("expected the request span to be a child of the lookup span")
+		}
+		if span.Tag("kea.endpoint") != server.URL {
+			t.Errorf("unexpected endpoint %v", span.Tag("kea.endpoint"))
+		}
+	}
+	lease4 := requests["lease4-get-by-hostname"]
+	if lease4 == nil || lease4.Tag("kea.service") != "dhcp4" || lease4.Tag("kea.result") != "success" {
+		t.Errorf("unexpected lease4 request span %+v", lease4)
+	}
+	lease6 := requests["lease6-get-by-hostname"]
+	if lease6 == nil || lease6.Tag("error") != true {
+		t.Errorf("expected the failed lease6 request span to be marked as an error, got %+v", lease6)
+	}
+}
+
+func TestLookupNameWithoutTrace(t *testing.T) {
+	span, ctx := startSpan(context.Background(), "kea.lookup")
+	if span != nil || ctx != context.Background() {
+		t.Error("expected no span to be started for a query which isn't traced")
+	}
+}
@@ -0,0 +1,75 @@
+package kea
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Kea's lease states, as shown in TXT records.
+var leaseStates = map[int]string{
+	0: "default",
+	1: "declined",
+	2: "expired-reclaimed",
+	3: "released",
+	4: "registered",
+}
+
+// TXTAllowed reports whether a client may query TXT records. They reveal
+// device identifiers, so they are only answered for clients in TXTClients.
+func (k Kea) TXTAllowed(clientIP string) bool {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range k.TXTClients {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordTXT describes a record as a TXT record of key=value strings. Fields
+// Kea didn't return are left out. The TTL is 0 so the identifiers aren't
+// cached.
+func recordTXT(name string, record Record) *dns.TXT {
+	txt := []string{"address=" + record.IP.String(), "source=" + record.Kind}
+	add := func(key string, value string) {
+		if value != "" {
+			txt = append(txt, key+"="+value)
+		}
+	}
+	add("hw-address", record.HwAddress)
+	if record.IP.To4() != nil {
+		add("client-id", record.ClientID)
+	} else {
+		add("duid", record.ClientID)
+	}
+	add("subnet-id", recordSubnetID(record))
+	add("backend", record.Backend)
+	add("correlated", record.CorrelatedBy)
+	if record.Kind == RecordKindLease {
+		state, ok := leaseStates[record.State]
+		if !ok {
+			state = strconv.Itoa(record.State)
+		}
+		add("state", state)
+		if record.Cltt > 0 {
+			add("start", time.Unix(record.Cltt, 0).UTC().Format(time.RFC3339))
+		}
+		add("expiry", recordExpiry(record))
+	}
+	return &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    0,
+		},
+		Txt: txt,
+	}
+}
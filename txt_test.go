@@ -0,0 +1,64 @@
+package kea
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestServeTXT(t *testing.T) {
+	kea, _ := MakeTestKeaControlAgent(t)
+	kea.ExtractHostname = "true"
+	kea.Next = fallthroughHandler()
+	kea.TXTClients = []string{"10.240.0.0/16"}
+
+	disabled := kea
+	disabled.TXTClients = nil
+
+	tests := []struct {
+		kea      Kea
+		qname    string
+		remoteIP string
+		rcode    int
+		expected []string
+	}{
+		{kea, "laptop.example.org.", "10.240.0.1", dns.RcodeSuccess, []string{
+			`laptop.example.org.	0	IN	TXT	"address=10.0.0.20" "source=lease" "hw-address=00:11:22:33:44:66" "client-id=01:00:11:22:33:44:66" "subnet-id=1" "state=default" "start=2023-11-14T22:13:20Z" "expiry=2023-11-14T23:13:20Z"`,
+			`laptop.example.org.	0	IN	TXT	"address=2001:db8:1::20" "source=lease" "hw-address=00:11:22:33:44:66" "duid=00:03:00:01:00:11:22:33:44:66" "subnet-id=1" "state=default" "start=2023-11-14T22:13:20Z" "expiry=2023-11-14T23:13:20Z"`,
+		}},
+		{kea, "nas.example.org.", "10.240.0.1", dns.RcodeSuccess, []string{
+			`nas.example.org.	0	IN	TXT	"address=10.0.0.160" "source=reservation" "hw-address=00:11:22:33:44:88" "subnet-id=1"`,
+			`nas.example.org.	0	IN	TXT	"address=2001:db8:1::160" "source=reservation" "duid=00:03:00:01:00:11:22:33:44:88" "subnet-id=1"`,
+		}},
+		// Clients outside txt_records, and every client without it, fall through.
+		{kea, "laptop.example.org.", "192.0.2.1", dns.RcodeNameError, nil},
+		{disabled, "laptop.example.org.", "10.240.0.1", dns.RcodeNameError, nil},
+		{kea, "unknown.example.org.", "10.240.0.1", dns.RcodeNameError, nil},
+	}
+
+	for i, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, dns.TypeTXT)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: tc.remoteIP})
+		rcode, err := tc.kea.ServeDNS(context.Background(), rec, m)
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if rcode != tc.rcode {
+			t.Errorf("Test %d: expected rcode %s, got %s", i, dns.RcodeToString[tc.rcode], dns.RcodeToString[rcode])
+		}
+		if len(rec.Msg.Answer) != len(tc.expected) {
+			t.Errorf("Test %d: expected %d answers, got %v", i, len(tc.expected), rec.Msg.Answer)
+			continue
+		}
+		for j, rr := range rec.Msg.Answer {
+			if rr.String() != tc.expected[j] {
+				t.Errorf("Test %d: expected\n%s\ngot\n%s", i, tc.expected[j], rr)
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package kea
+
+import (
+	"context"
+	"net"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// WhoAmIRecords returns the record for a client's address, followed by the
+// other addresses of the same client found under its hostname. The record's
+// hostname is its synthetic name when it has none and one applies.
+func (k Kea) WhoAmIRecords(ctx context.Context, ip net.IP) (records []Record, err error) {
+	found, err := k.LookupAddr(ctx, ip)
+	if err != nil || len(found) == 0 {
+		return nil, err
+	}
+	self := found[0]
+	if name := k.syntheticName(self); name != "" {
+		self.Hostname = name
+		return []Record{self}, nil
+	}
+	records = []Record{self}
+	if self.Hostname == "" {
+		return records, nil
+	}
+
+	others, err := k.LookupName(ctx, self.Hostname)
+	if err != nil {
+		log.Warningf("Failed to look up the other addresses of %s: %v", self.Hostname, err)
+		return records, nil
+	}
+	client := recordClient(self)
+	for _, other := range others {
+		if containsIP(records, other) {
+			continue
+		}
+		if client != "" && recordClient(other) != "" && !sameClient(self, other) {
+			continue
+		}
+		records = append(records, other)
+	}
+	return records, nil
+}
+
+// serveWhoAmI answers the whoami name with what Kea knows about the querying
+// client: its addresses for A and AAAA queries, its hostname for PTR queries
+// and its lease for TXT queries. The answers differ for every client, so
+// their TTL is 0.
+func (k Kea) serveWhoAmI(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, state request.Request, server string) (int, error) {
+	records, err := k.WhoAmIRecords(ctx, net.ParseIP(state.IP()))
+	if err != nil {
+		queryOutcomes.WithLabelValues(server, state.Type(), OutcomeError).Inc()
+		return plugin.NextOrFailure(k.Name(), k.Next, ctx, w, r)
+	}
+	if len(records) == 0 {
+		queryOutcomes.WithLabelValues(server, state.Type(), OutcomeFallthrough).Inc()
+		return plugin.NextOrFailure(k.Name(), k.Next, ctx, w, r)
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	m.RecursionAvailable = false
+
+	self := records[0]
+	header := dns.RR_Header{Name: state.QName(), Rrtype: state.QType(), Class: dns.ClassINET, Ttl: 0}
+	switch state.QType() {
+	case dns.TypeA, dns.TypeAAAA:
+		for _, record := range records {
+			if ip := record.IP.To4(); ip != nil && state.QType() == dns.TypeA {
+				m.Answer = append(m.Answer, &dns.A{Hdr: header, A: ip})
+			} else if ip == nil && state.QType() == dns.TypeAAAA {
+				m.Answer = append(m.Answer, &dns.AAAA{Hdr: header, AAAA: record.IP})
+			}
+		}
+	case dns.TypePTR:
+		if self.Hostname != "" {
+			m.Answer = append(m.Answer, &dns.PTR{Hdr: header, Ptr: dns.Fqdn(self.Hostname)})
+		}
+	case dns.TypeTXT:
+		txt := recordTXT(state.QName(), self)
+		if self.Hostname != "" {
+			txt.Txt = append([]string{"hostname=" + self.Hostname}, txt.Txt...)
+		}
+		m.Answer = append(m.Answer, txt)
+	}
+
+	if len(m.Answer) == 0 {
+		queryOutcomes.WithLabelValues(server, state.Type(), OutcomeNoData).Inc()
+		return plugin.NextOrFailure(k.Name(), k.Next, ctx, w, r)
+	}
+	setAnswered(ctx, self)
+	queryOutcomes.WithLabelValues(server, state.Type(), OutcomeAnswered).Inc()
+	return 0, w.WriteMsg(m)
+}
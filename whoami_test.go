@@ -0,0 +1,57 @@
+package kea
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestServeWhoAmI(t *testing.T) {
+	kea, _ := MakeTestKeaControlAgent(t)
+	kea.WhoAmI = "whoami.lan"
+	kea.Next = fallthroughHandler()
+
+	tests := []struct {
+		qtype    uint16
+		remoteIP string
+		rcode    int
+		expected []string
+	}{
+		{dns.TypeA, "10.0.0.20", dns.RcodeSuccess, []string{"whoami.lan.	0	IN	A	10.0.0.20"}},
+		{dns.TypeAAAA, "10.0.0.20", dns.RcodeSuccess, []string{"whoami.lan.	0	IN	AAAA	2001:db8:1::20"}},
+		{dns.TypeA, "2001:db8:1::20", dns.RcodeSuccess, []string{"whoami.lan.	0	IN	A	10.0.0.20"}},
+		{dns.TypePTR, "10.0.0.20", dns.RcodeSuccess, []string{"whoami.lan.	0	IN	PTR	laptop."}},
+		{dns.TypeTXT, "10.0.0.21", dns.RcodeSuccess, []string{
+			`whoami.lan.	0	IN	TXT	"hostname=printer" "address=10.0.0.21" "source=lease" "hw-address=00:11:22:33:44:77" "subnet-id=1" "state=default" "start=2023-11-14T22:13:20Z" "expiry=2023-11-14T23:13:20Z"`,
+		}},
+		// The printer has no IPv6 lease, and clients without a lease fall through.
+		{dns.TypeAAAA, "10.0.0.21", dns.RcodeNameError, nil},
+		{dns.TypeA, "10.240.0.1", dns.RcodeNameError, nil},
+	}
+
+	for i, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion("whoami.lan.", tc.qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: tc.remoteIP})
+		rcode, err := kea.ServeDNS(context.Background(), rec, m)
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if rcode != tc.rcode {
+			t.Errorf("Test %d: expected rcode %s, got %s", i, dns.RcodeToString[tc.rcode], dns.RcodeToString[rcode])
+		}
+		if len(rec.Msg.Answer) != len(tc.expected) {
+			t.Errorf("Test %d: expected %d answers, got %v", i, len(tc.expected), rec.Msg.Answer)
+			continue
+		}
+		for j, rr := range rec.Msg.Answer {
+			if rr.String() != tc.expected[j] {
+				t.Errorf("Test %d: expected\n%s\ngot\n%s", i, tc.expected[j], rr)
+			}
+		}
+	}
+}